@@ -0,0 +1,192 @@
+// Package api serves queries over the archives of the feeds being captured by
+// the daemon, so data can be read without stopping it.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scascketta/capmetricsd/daemon"
+	"github.com/scascketta/capmetricsd/tools"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	elog = log.New(os.Stderr, "[ERR] ", log.LstdFlags|log.Lshortfile)
+
+	contentTypes = map[string]string{
+		"csv":           "text/csv; charset=utf-8",
+		"json":          "application/json",
+		"jsonl":         "application/x-ndjson",
+		"geojson":       "application/geo+json",
+		"geojson-lines": "application/geo+json",
+		"parquet":       "application/vnd.apache.parquet",
+		"gtfsrt":        "application/x-protobuf",
+		"metrics":       "text/plain; version=0.0.4; charset=utf-8",
+	}
+)
+
+// Handler returns the API's routes:
+//
+//	GET /feeds      the feeds being captured
+//	GET /locations  vehicle locations, see getLocations
+//	GET /metrics    the daemon's metrics, for Prometheus
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feeds", listFeeds)
+	mux.HandleFunc("/locations", getLocations)
+	mux.HandleFunc("/metrics", getMetrics)
+	return mux
+}
+
+type feedInfo struct {
+	Name   string `json:"name"`
+	DBPath string `json:"db_path"`
+}
+
+func listFeeds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	feeds := []feedInfo{}
+	for _, archive := range daemon.Archives() {
+		feeds = append(feeds, feedInfo{Name: archive.Name, DBPath: archive.Path})
+	}
+
+	w.Header().Set("Content-Type", contentTypes["json"])
+	json.NewEncoder(w).Encode(feeds)
+}
+
+// findArchive returns the archive of the requested feed. The feed can be
+// omitted if only one is being captured.
+func findArchive(r *http.Request) (*daemon.Archive, error) {
+	name := r.FormValue("feed")
+	if name != "" {
+		archive := daemon.FindArchive(name)
+		if archive == nil {
+			return nil, fmt.Errorf("unknown feed: %s", name)
+		}
+		return archive, nil
+	}
+
+	archives := daemon.Archives()
+	if len(archives) != 1 {
+		return nil, fmt.Errorf("%d feeds are being captured, choose one with the feed parameter", len(archives))
+	}
+	return archives[0], nil
+}
+
+// listParam returns every value of a parameter, which may be repeated or
+// given as a comma separated list.
+func listParam(r *http.Request, name string) []string {
+	var values []string
+	for _, param := range r.Form[name] {
+		for _, value := range strings.Split(param, ",") {
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// getLocations serves the locations in the range given by from and to, date or
+// last, read like get's flags, optionally filtered by route, trip, vehicle and
+// bbox and ordered by sort.
+// The format parameter picks json (the default) or any other of
+// tools.LocationFormats.
+func getLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archive, err := findArchive(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	if !tools.IsLocationFormat(format) {
+		http.Error(w, fmt.Sprintf("unknown format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	q := &tools.LocationQuery{
+		Routes:   listParam(r, "route"),
+		Trips:    listParam(r, "trip"),
+		Vehicles: listParam(r, "vehicle"),
+		Sort:     r.FormValue("sort"),
+	}
+	tr := &tools.TimeRange{
+		From:            r.FormValue("from"),
+		To:              r.FormValue("to"),
+		Date:            r.FormValue("date"),
+		Last:            r.FormValue("last"),
+		TZ:              r.FormValue("tz"),
+		ServiceDayStart: r.FormValue("service_day_start"),
+	}
+	if !tr.IsSet() {
+		http.Error(w, "a range is required: from and to, date or last", http.StatusBadRequest)
+		return
+	}
+	if q.Min, q.Max, err = tr.Resolve(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bbox := r.FormValue("bbox"); bbox != "" {
+		if q.BBox, err = tools.ParseBBox(bbox); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err = q.SortFor(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = q.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// locations are written as they're read, so once the response has
+	// started an error can only cut it short
+	w.Header().Set("Content-Type", contentTypes[format])
+	lw, err := tools.NewLocationWriter(w, format)
+	if err != nil {
+		elog.Println(err)
+		return
+	}
+	if err = tools.ScanLocations(archive, q, lw.Write); err != nil {
+		elog.Println(err)
+		return
+	}
+	if err = lw.Close(); err != nil {
+		elog.Println(err)
+	}
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes["metrics"])
+	if err := daemon.WriteMetrics(w); err != nil {
+		elog.Println(err)
+	}
+}
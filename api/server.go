@@ -0,0 +1,123 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// READ_TIMEOUT bounds reading a request, and before Go 1.8 added
+	// http.Server's IdleTimeout it's also how long an idle keep-alive
+	// connection is kept open
+	READ_TIMEOUT = 30 * time.Second
+	// WRITE_TIMEOUT bounds writing a response, which is generous since
+	// locations are streamed for as long as a query takes
+	WRITE_TIMEOUT = 10 * time.Minute
+	// SHUTDOWN_TIMEOUT is how long Close waits for requests in progress
+	// before closing their connections
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+)
+
+// Server serves the API until it's closed.
+type Server struct {
+	http.Server
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	conns    map[net.Conn]http.ConnState
+}
+
+func NewServer(addr string) *Server {
+	s := &Server{conns: map[net.Conn]http.ConnState{}}
+	s.Addr = addr
+	s.Handler = Handler()
+	s.ReadTimeout = READ_TIMEOUT
+	s.WriteTimeout = WRITE_TIMEOUT
+	s.ConnState = s.trackConn
+	return s
+}
+
+// ListenAndServe serves the API on the server's address. It returns nil once
+// the server is closed.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	log.Printf("Serving HTTP API on %s\n", listener.Addr())
+	err = s.Serve(listener)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) trackConn(conn net.Conn, state http.ConnState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(s.conns, conn)
+	default:
+		s.conns[conn] = state
+		if s.closed && state == http.StateIdle {
+			conn.Close()
+		}
+	}
+}
+
+// Close stops accepting connections and waits up to SHUTDOWN_TIMEOUT for
+// requests in progress to finish, then closes every connection.
+func (s *Server) Close() (err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.SetKeepAlivesEnabled(false)
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn, state := range s.conns {
+		if state != http.StateActive {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(SHUTDOWN_TIMEOUT)
+	for {
+		s.mu.Lock()
+		remaining := len(s.conns)
+		if remaining == 0 || time.Now().After(deadline) {
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			if remaining > 0 {
+				log.Printf("Closed %d HTTP API connection(s) with requests still in progress\n", remaining)
+			}
+			return
+		}
+		s.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
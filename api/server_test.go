@@ -0,0 +1,81 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestServerClose(t *testing.T) {
+	started := make(chan struct{})
+	s := NewServer(freeAddr(t))
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		// the server may not be listening yet
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + s.Addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	select {
+	case <-started:
+	case r := <-responses:
+		t.Fatalf("request finished before it was handled: %+v", r)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("closing: %s", err)
+	}
+
+	// the request in progress was allowed to finish
+	if r := <-responses; r.err != nil || r.body != "done" {
+		t.Errorf("got %q, %v for the request in progress, want done", r.body, r.err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ListenAndServe returned %s after closing, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe didn't return after closing")
+	}
+	if _, err := net.Dial("tcp", s.Addr); err == nil {
+		t.Error("still accepting connections after closing")
+	}
+}
@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"time"
+)
+
+func CaptureAlerts(fetcher *Fetcher, url string, db *bolt.DB, archiveRaw bool) (err error) {
+	pb, err := fetcher.Get(RAW_ALERTS, url)
+	if err != nil {
+		return
+	}
+
+	if archiveRaw {
+		if err := ArchiveRawFeed(db, RAW_ALERTS, pb); err != nil {
+			elog.Println(err)
+		}
+	}
+
+	alerts, err := decodeAlerts(pb)
+	if err != nil {
+		return &decodeError{RAW_ALERTS, err}
+	}
+
+	created, err := storeAlerts(db, alerts)
+	if err != nil {
+		return
+	}
+
+	dlog.Printf("Alerts: %d\n", len(alerts))
+	dlog.Printf("New alerts: %d\n", created)
+
+	fetcher.Captured(RAW_ALERTS, url)
+	return
+}
+
+func decodeAlerts(pb []byte) (alerts []*gtfsrt.ArchivedAlert, err error) {
+	start := time.Now()
+	fm := new(gtfsrt.FeedMessage)
+	if err = proto.Unmarshal(pb, fm); err != nil {
+		return nil, err
+	}
+
+	seen := int64(fm.GetHeader().GetTimestamp())
+	if seen == 0 {
+		seen = time.Now().Unix()
+	}
+
+	for _, entity := range fm.GetEntity() {
+		alert := entity.GetAlert()
+		if alert == nil {
+			continue
+		}
+
+		id, err := alertID(alert)
+		if err != nil {
+			return nil, err
+		}
+
+		alerts = append(alerts, &gtfsrt.ArchivedAlert{
+			Id:        proto.String(id),
+			EntityId:  proto.String(entity.GetId()),
+			FirstSeen: proto.Int64(seen),
+			LastSeen:  proto.Int64(seen),
+			Alert:     alert,
+		})
+	}
+
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed decoding Alerts PB file: %.0fms\n", end.Seconds()*1000)
+
+	return alerts, nil
+}
+
+// alertID identifies an alert by its content rather than its entity ID, since
+// producers are free to reuse entity IDs between feed messages.
+func alertID(alert *gtfsrt.Alert) (string, error) {
+	data, err := proto.Marshal(alert)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AlertRoutes returns the IDs of every route an alert informs, either directly
+// or through a trip.
+func AlertRoutes(alert *gtfsrt.Alert) []string {
+	var routes []string
+	seen := map[string]bool{}
+
+	for _, entity := range alert.GetInformedEntity() {
+		route := entity.GetRouteId()
+		if route == "" {
+			route = entity.GetTrip().GetRouteId()
+		}
+		if route != "" && !seen[route] {
+			seen[route] = true
+			routes = append(routes, route)
+		}
+	}
+
+	return routes
+}
+
+// storeAlerts saves alerts which haven't been seen before and extends the last
+// seen time of those that have, returning the number of new alerts.
+func storeAlerts(db *bolt.DB, alerts []*gtfsrt.ArchivedAlert) (created int, err error) {
+	start := time.Now()
+	err = updateWithRetry(db, func(tx *bolt.Tx) error {
+		created = 0
+		alertsBucket, err := tx.CreateBucketIfNotExists([]byte(ALERTS_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+		routesBucket, err := tx.CreateBucketIfNotExists([]byte(ALERT_ROUTES_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		for _, alert := range alerts {
+			key := []byte(alert.GetId())
+
+			if existing := alertsBucket.Get(key); existing != nil {
+				var stored gtfsrt.ArchivedAlert
+				if err := proto.Unmarshal(existing, &stored); err != nil {
+					return err
+				}
+				if alert.GetLastSeen() <= stored.GetLastSeen() {
+					continue
+				}
+				stored.LastSeen = alert.LastSeen
+				alert = &stored
+			} else {
+				created++
+				for _, route := range AlertRoutes(alert.GetAlert()) {
+					routeBucket, err := routesBucket.CreateBucketIfNotExists([]byte(route))
+					if err != nil {
+						return err
+					}
+					if err := routeBucket.Put(key, []byte{}); err != nil {
+						return err
+					}
+				}
+			}
+
+			data, err := proto.Marshal(alert)
+			if err != nil {
+				return err
+			}
+			if err := alertsBucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed saving alerts to BoltDB:  %.0fms\n", end.Seconds()*1000)
+	return
+}
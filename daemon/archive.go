@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"github.com/boltdb/bolt"
+	"sort"
+	"sync"
+)
+
+// Viewer runs read-only transactions. Both *bolt.DB and *Archive are Viewers,
+// so the same queries can be run against a database opened directly or one
+// held open by the daemon.
+type Viewer interface {
+	View(fn func(*bolt.Tx) error) error
+}
+
+// Archive gives read access to the database of a feed while the daemon is
+// capturing it. Bolt only lets one process open a database, so reads have to
+// go through the daemon's handle.
+type Archive struct {
+	Name string
+	Path string
+
+	mu sync.RWMutex
+	db *bolt.DB
+	// readers counts the transactions open on db, which can't be closed
+	// until they've finished
+	readers *sync.WaitGroup
+}
+
+func newArchive(name, path string, db *bolt.DB) *Archive {
+	return &Archive{Name: name, Path: path, db: db, readers: new(sync.WaitGroup)}
+}
+
+// View runs fn in a read-only transaction, which doesn't block captures.
+func (a *Archive) View(fn func(*bolt.Tx) error) error {
+	a.mu.RLock()
+	db, readers := a.db, a.readers
+	readers.Add(1)
+	a.mu.RUnlock()
+	defer readers.Done()
+
+	if db == nil {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return db.View(fn)
+}
+
+// replace points the archive at another handle of its database, or nil once
+// it's closed. It returns a func which waits for the transactions still open
+// on the old handle, after which it can be closed.
+func (a *Archive) replace(db *bolt.DB) (wait func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	readers := a.readers
+	a.db, a.readers = db, new(sync.WaitGroup)
+	return readers.Wait
+}
+
+var (
+	archivesMu sync.RWMutex
+	archives   = map[string]*Archive{}
+)
+
+func registerArchive(a *Archive) {
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	archives[a.Name] = a
+}
+
+func unregisterArchive(name string) {
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	delete(archives, name)
+}
+
+// Archives returns the archives of every feed currently being captured,
+// sorted by feed name.
+func Archives() []*Archive {
+	archivesMu.RLock()
+	defer archivesMu.RUnlock()
+
+	list := make([]*Archive, 0, len(archives))
+	for _, a := range archives {
+		list = append(list, a)
+	}
+	sort.Sort(byName(list))
+	return list
+}
+
+// FindArchive returns the archive of the named feed, or nil if it isn't being
+// captured.
+func FindArchive(name string) *Archive {
+	archivesMu.RLock()
+	defer archivesMu.RUnlock()
+	return archives[name]
+}
+
+type byName []*Archive
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
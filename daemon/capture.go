@@ -1,60 +1,98 @@
 package daemon
 
 import (
+	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
 	"github.com/montanaflynn/stats"
 	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
-	"io/ioutil"
-	"net/http"
-	"strconv"
 	"time"
 )
 
 type locationBins map[string][]*gtfsrt.VehicleLocation
 
-func CaptureLocations(url string, db *bolt.DB) (err error) {
-	pb, err := getLocations(url)
+// binStats counts what happened to locations which couldn't be stored as-is.
+type binStats struct {
+	// locations identical to one already seen for the same trip, vehicle and time
+	duplicates int
+	// locations which differ from one already seen for the same trip, vehicle
+	// and time, only the first is kept
+	conflicts int
+	// trips served by more than one vehicle, e.g. duplicated vehicles
+	sharedTrips int
+}
+
+// LocationStats counts the locations in a Vehicle Positions feed.
+type LocationStats struct {
+	// every vehicle position in the feed
+	Seen int `json:"seen"`
+	// positions with a route, trip and vehicle
+	Valid int `json:"valid"`
+	// valid locations stored, excluding duplicates and dead letters
+	Stored int `json:"stored"`
+	// trips with valid locations
+	Trips int `json:"trips"`
+}
+
+// decodeError is returned when a feed can't be decoded, so it can be told
+// apart from errors fetching and storing feeds.
+type decodeError struct {
+	kind string
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("Error decoding %s feed: %s", e.kind, e.err)
+}
+
+// CaptureLocations fetches, decodes and stores a Vehicle Positions feed,
+// returning counts of the locations it held. Locations which can't be
+// stored are appended to the dead letter file at deadLetterPath and reported
+// in the returned error. If archiveRaw is set, the feed is archived as-is
+// before it's decoded. If the feed hasn't changed since it was last captured,
+// ErrNotModified or ErrStaleFeed is returned and nothing is stored.
+func CaptureLocations(fetcher *Fetcher, url string, db *bolt.DB, deadLetterPath string, archiveRaw bool) (stats LocationStats, err error) {
+	pb, err := fetcher.Get(RAW_VEHICLE_POSITIONS, url)
 	if err != nil {
 		return
 	}
 
+	if archiveRaw {
+		if err := ArchiveRawFeed(db, RAW_VEHICLE_POSITIONS, pb); err != nil {
+			elog.Println(err)
+		}
+	}
+
 	locations, err := decodeProtobuf(pb)
 	if err != nil {
-		return
+		return stats, &decodeError{RAW_VEHICLE_POSITIONS, err}
 	}
 
 	filtered := filterLocations(locations)
+	tripBins, binned := binLocations(filtered)
 
-	tripBins := binLocations(filtered)
+	failed := storeLocations(db, tripBins)
 
-	if err = storeLocations(db, tripBins); err != nil {
-		return
+	stats = LocationStats{Seen: len(locations), Valid: len(filtered), Trips: len(tripBins)}
+	for _, locations := range tripBins {
+		stats.Stored += len(locations)
 	}
+	stats.Stored -= len(failed)
 
 	describeLocations(filtered)
-	printStats(len(locations), len(filtered), len(tripBins))
+	printStats(len(locations), len(filtered), len(tripBins), binned)
 
-	return
-}
-
-func getLocations(url string) (pb []byte, err error) {
-	start := time.Now()
-	pb = []byte{}
-
-	res, err := http.Get(url)
-	if err != nil {
-		return
-	}
-
-	pb, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		return
+	if len(failed) > 0 {
+		if err = writeDeadLetters(deadLetterPath, failed); err != nil {
+			return stats, fmt.Errorf("Error writing %d unstored locations to dead letter file %s: %s", len(failed), deadLetterPath, err)
+		}
+		// the locations are safe in the dead letter file, so the feed isn't
+		// fetched and stored again
+		fetcher.Captured(RAW_VEHICLE_POSITIONS, url)
+		return stats, fmt.Errorf("%d of %d locations couldn't be stored, written to dead letter file %s (first error: %s)", len(failed), len(filtered), deadLetterPath, failed[0].err)
 	}
-	res.Body.Close()
 
-	end := time.Now().Sub(start)
-	dlog.Printf("Time elapsed downloading PB file: %.0fms\n", end.Seconds()*1000)
+	fetcher.Captured(RAW_VEHICLE_POSITIONS, url)
 	return
 }
 
@@ -65,6 +103,16 @@ func decodeProtobuf(pb []byte) (locations []*gtfsrt.VehicleLocation, err error)
 		return nil, err
 	}
 
+	locations = vehicleLocations(fm)
+
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed decoding PB file: %.0fms\n", end.Seconds()*1000)
+
+	return locations, nil
+}
+
+// vehicleLocations converts each VehiclePosition of a feed to a location.
+func vehicleLocations(fm *gtfsrt.FeedMessage) (locations []*gtfsrt.VehicleLocation) {
 	for _, entity := range fm.GetEntity() {
 		vehicle := entity.GetVehicle()
 		trip := vehicle.GetTrip()
@@ -80,13 +128,37 @@ func decodeProtobuf(pb []byte) (locations []*gtfsrt.VehicleLocation, err error)
 			Longitude: proto.Float32(position.GetLongitude()),
 		}
 
+		// optional fields are only set if the feed includes them, so they can
+		// be told apart from zero values
+		if position != nil {
+			loc.Bearing = position.Bearing
+			loc.Odometer = position.Odometer
+		}
+		if trip != nil {
+			loc.StartDate = trip.StartDate
+			loc.StartTime = trip.StartTime
+		}
+		if descriptor := vehicle.GetVehicle(); descriptor != nil {
+			loc.VehicleLabel = descriptor.Label
+		}
+		if vehicle != nil {
+			loc.StopId = vehicle.StopId
+			loc.CurrentStopSequence = vehicle.CurrentStopSequence
+			if vehicle.CurrentStatus != nil {
+				loc.CurrentStatus = proto.String(vehicle.GetCurrentStatus().String())
+			}
+			if vehicle.CongestionLevel != nil {
+				loc.CongestionLevel = proto.String(vehicle.GetCongestionLevel().String())
+			}
+			if vehicle.OccupancyStatus != nil {
+				loc.OccupancyStatus = proto.String(vehicle.GetOccupancyStatus().String())
+			}
+		}
+
 		locations = append(locations, loc)
 	}
 
-	end := time.Now().Sub(start)
-	dlog.Printf("Time elapsed decoding PB file: %.0fms\n", end.Seconds()*1000)
-
-	return locations, nil
+	return
 }
 
 func filterLocations(locations []*gtfsrt.VehicleLocation) []*gtfsrt.VehicleLocation {
@@ -102,17 +174,43 @@ func filterLocations(locations []*gtfsrt.VehicleLocation) []*gtfsrt.VehicleLocat
 	return filtered
 }
 
-func binLocations(locations []*gtfsrt.VehicleLocation) locationBins {
+// binLocations groups locations by trip, keeping one location per vehicle and
+// timestamp since that's the key each is stored under.
+func binLocations(locations []*gtfsrt.VehicleLocation) (locationBins, binStats) {
 	bins := locationBins{}
+	counts := binStats{}
+	seen := map[string]map[string]*gtfsrt.VehicleLocation{}
+	vehicles := map[string]map[string]bool{}
 
 	for _, loc := range locations {
 		trip := loc.GetTripId()
-		if _, ok := bins[trip]; !ok {
-			bins[trip] = append(bins[trip], loc)
+		if seen[trip] == nil {
+			seen[trip] = map[string]*gtfsrt.VehicleLocation{}
+			vehicles[trip] = map[string]bool{}
+		}
+
+		key := string(LocationKey(loc.GetTimestamp(), loc.GetVehicleId()))
+		if prev, ok := seen[trip][key]; ok {
+			if proto.Equal(prev, loc) {
+				counts.duplicates++
+			} else {
+				counts.conflicts++
+			}
+			continue
+		}
+		seen[trip][key] = loc
+
+		vehicles[trip][loc.GetVehicleId()] = true
+		bins[trip] = append(bins[trip], loc)
+	}
+
+	for _, v := range vehicles {
+		if len(v) > 1 {
+			counts.sharedTrips++
 		}
 	}
 
-	return bins
+	return bins, counts
 }
 
 func describeLocations(locations []*gtfsrt.VehicleLocation) {
@@ -134,31 +232,46 @@ func describeLocations(locations []*gtfsrt.VehicleLocation) {
 	dlog.Printf("Mean speed: %f", meanSpeed)
 }
 
-func storeLocations(db *bolt.DB, tripBins locationBins) error {
+// storeLocations saves every location from a fetch in a single transaction,
+// so a snapshot is either stored completely or not at all. Locations which
+// can never be stored are skipped, the rest are retried if the transaction
+// fails. Any locations left unstored are returned.
+func storeLocations(db *bolt.DB, tripBins locationBins) (failed []failedLocation) {
 	start := time.Now()
-	for trip, locations := range tripBins {
-		if trip == "" {
-			continue
+	err := updateWithRetry(db, func(tx *bolt.Tx) error {
+		failed = nil
+		for trip, locations := range tripBins {
+			if trip == "" {
+				continue
+			}
+			tripBytes := []byte(trip)
+			for _, location := range locations {
+				err := storeSingleLocation(tripBytes, location, tx)
+				if permanentErrors[err] {
+					failed = append(failed, failedLocation{location, err})
+				} else if err != nil {
+					return err
+				}
+			}
 		}
-		tripBytes := []byte(trip)
-		for _, location := range locations {
-			err := db.Update(func(tx *bolt.Tx) error {
-				return storeSingleLocation(tripBytes, location, tx)
-			})
-
-			if err != nil {
-				return err
+		return nil
+	})
+	if err != nil {
+		failed = nil
+		for _, locations := range tripBins {
+			for _, location := range locations {
+				failed = append(failed, failedLocation{location, err})
 			}
 		}
-
+		return
 	}
 	end := time.Now().Sub(start)
 	dlog.Printf("Time elapsed saving locations to BoltDB:  %.0fms\n", end.Seconds()*1000)
-	return nil
+	return
 }
 
 func storeSingleLocation(tripID []byte, location *gtfsrt.VehicleLocation, tx *bolt.Tx) (err error) {
-	topBucket, err := tx.CreateBucketIfNotExists([]byte(BUCKET_NAME))
+	topBucket, err := CreateLocationsBucket(tx)
 	if err != nil {
 		return
 	}
@@ -172,19 +285,20 @@ func storeSingleLocation(tripID []byte, location *gtfsrt.VehicleLocation, tx *bo
 		return
 	}
 
-	// key is POSIX time
-	ts := location.GetTimestamp()
-	key := strconv.Itoa(int(ts))
+	key := LocationKey(location.GetTimestamp(), location.GetVehicleId())
 
-	err = tripBucket.Put([]byte(key), data)
-	if err != nil {
-		elog.Fatal(err)
+	if err = tripBucket.Put(key, data); err != nil {
+		return
 	}
-	return
+
+	return IndexLocation(tx, tripID, key, location)
 }
 
-func printStats(numLocations, numFiltered, numTrips int) {
+func printStats(numLocations, numFiltered, numTrips int, binned binStats) {
 	dlog.Printf("Locations: %d\n", numLocations)
 	dlog.Printf("Valid locations: %d\n", numFiltered)
 	dlog.Printf("Valid trips: %d\n", numTrips)
+	dlog.Printf("Duplicate locations: %d\n", binned.duplicates)
+	dlog.Printf("Conflicting locations: %d\n", binned.conflicts)
+	dlog.Printf("Trips with multiple vehicles: %d\n", binned.sharedTrips)
 }
@@ -0,0 +1,272 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration which can be read from a config file either as
+// a string like "30s" or "90d", or as a number of seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		d.Duration = time.Duration(value * float64(time.Second))
+	case string:
+		parsed, err := ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	return nil
+}
+
+// fsyncPolicy controls when Bolt flushes committed writes to disk.
+type fsyncPolicy struct {
+	never    bool
+	interval time.Duration
+}
+
+// parseFsyncPolicy parses "always" (fsync every commit, the default), "never"
+// (leave flushing to the OS) or a duration to fsync at most once per interval.
+func parseFsyncPolicy(s string) (fsyncPolicy, error) {
+	switch s {
+	case "", "always":
+		return fsyncPolicy{}, nil
+	case "never":
+		return fsyncPolicy{never: true}, nil
+	}
+
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		return fsyncPolicy{}, fmt.Errorf("invalid fsync policy: %s", s)
+	}
+	return fsyncPolicy{interval: interval}, nil
+}
+
+func (p fsyncPolicy) noSync() bool {
+	return p.never || p.interval > 0
+}
+
+func (p fsyncPolicy) String() string {
+	switch {
+	case p.never:
+		return "never"
+	case p.interval > 0:
+		return p.interval.String()
+	}
+	return "always"
+}
+
+// FeedConfig describes a single agency's GTFS-realtime feeds and where to
+// archive them.
+type FeedConfig struct {
+	Name                string   `json:"name"`
+	VehiclePositionsURL string   `json:"vehicle_positions_url"`
+	TripUpdatesURL      string   `json:"trip_updates_url"`
+	AlertsURL           string   `json:"alerts_url"`
+	Interval            Duration `json:"interval"`
+	Adaptive            bool     `json:"adaptive"`
+	MinInterval         Duration `json:"min_interval"`
+	MaxInterval         Duration `json:"max_interval"`
+	DBPath              string   `json:"db_path"`
+	Fsync               string   `json:"fsync"`
+	DeadLetterPath      string   `json:"dead_letter_path"`
+	ArchiveRaw          bool     `json:"archive_raw"`
+	Retention           Duration `json:"retention"`
+	CronitorURL         string   `json:"cronitor_url"`
+	// Notifiers are told about each capture, and FailAfter is how many
+	// captures have to fail in a row before they're told about a failure.
+	Notifiers []NotifierConfig `json:"notifiers"`
+	FailAfter int              `json:"fail_after"`
+
+	// how feeds are requested, e.g. headers and timeouts, is configured
+	// alongside the fields above
+	FetcherConfig
+
+	fsync     fsyncPolicy
+	notifiers []Notifier
+}
+
+// Config is the set of feeds captured by a single daemon.
+type Config struct {
+	Feeds []FeedConfig `json:"feeds"`
+	// HTTPAddr is the address to serve the query API and metrics on, if any.
+	HTTPAddr string `json:"http_addr"`
+}
+
+// LoadConfig reads a config file, which is YAML if its name ends in .yaml or
+// .yml and JSON otherwise.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("Error parsing config file %s: %s", path, err)
+		}
+	}
+
+	config := new(Config)
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %s", path, err)
+	}
+
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so YAML configs are read with
+// the same field names and parsing as JSON ones.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue converts a value decoded from YAML to one encoding/json can
+// marshal, whose mappings have string keys.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			var err error
+			switch key.(type) {
+			case string, int, bool, float64:
+			default:
+				return nil, fmt.Errorf("unsupported key: %v", key)
+			}
+			if m[fmt.Sprint(key)], err = jsonValue(value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, value := range v {
+			var err error
+			if list[i], err = jsonValue(value); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return v, nil
+}
+
+// Validate checks each feed is complete and fills in defaults.
+func (c *Config) Validate() error {
+	if len(c.Feeds) == 0 {
+		return fmt.Errorf("no feeds configured")
+	}
+
+	names := map[string]bool{}
+	dbPaths := map[string]bool{}
+
+	for i := range c.Feeds {
+		feed := &c.Feeds[i]
+
+		if feed.Name == "" {
+			feed.Name = fmt.Sprintf("feed-%d", i)
+		}
+		if names[feed.Name] {
+			return fmt.Errorf("duplicate feed name: %s", feed.Name)
+		}
+		names[feed.Name] = true
+
+		if feed.VehiclePositionsURL == "" && feed.TripUpdatesURL == "" && feed.AlertsURL == "" {
+			return fmt.Errorf("feed %s has no URLs to capture", feed.Name)
+		}
+
+		if feed.DBPath == "" {
+			return fmt.Errorf("feed %s is missing a db_path", feed.Name)
+		}
+		// Bolt holds an exclusive lock on its file, so feeds sharing a database
+		// would only block each other.
+		if dbPaths[feed.DBPath] {
+			return fmt.Errorf("feed %s shares db_path %s with another feed", feed.Name, feed.DBPath)
+		}
+		dbPaths[feed.DBPath] = true
+
+		if feed.Interval.Duration <= 0 {
+			feed.Interval.Duration = LOG_INTERVAL
+		}
+		if feed.Adaptive {
+			if feed.MinInterval.Duration <= 0 {
+				feed.MinInterval.Duration = ADAPTIVE_MIN_INTERVAL
+			}
+			if feed.MaxInterval.Duration <= 0 {
+				feed.MaxInterval.Duration = ADAPTIVE_MAX_INTERVAL
+			}
+			if feed.MinInterval.Duration > feed.MaxInterval.Duration {
+				return fmt.Errorf("feed %s has a min_interval longer than its max_interval", feed.Name)
+			}
+		}
+
+		if feed.DeadLetterPath == "" {
+			feed.DeadLetterPath = feed.DBPath + ".deadletter.jsonl"
+		}
+
+		if feed.Retention.Duration < 0 {
+			return fmt.Errorf("feed %s has an invalid retention: %s", feed.Name, feed.Retention)
+		}
+
+		policy, err := parseFsyncPolicy(feed.Fsync)
+		if err != nil {
+			return fmt.Errorf("feed %s: %s", feed.Name, err)
+		}
+		feed.fsync = policy
+
+		if err = feed.FetcherConfig.validate(); err != nil {
+			return fmt.Errorf("feed %s: %s", feed.Name, err)
+		}
+
+		if feed.FailAfter < 0 {
+			return fmt.Errorf("feed %s has an invalid fail_after: %d", feed.Name, feed.FailAfter)
+		}
+		if feed.FailAfter == 0 {
+			feed.FailAfter = 1
+		}
+		feed.notifiers = nil
+		if feed.CronitorURL != "" {
+			feed.notifiers = append(feed.notifiers, &pingNotifier{url: feed.CronitorURL})
+		}
+		for _, nc := range feed.Notifiers {
+			notifier, err := NewNotifier(nc)
+			if err != nil {
+				return fmt.Errorf("feed %s: %s", feed.Name, err)
+			}
+			feed.notifiers = append(feed.notifiers, notifier)
+		}
+	}
+
+	return nil
+}
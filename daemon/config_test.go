@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlConfig = `# capture two agencies
+http_addr: ":8080"
+feeds:
+  - name: capmetro
+    vehicle_positions_url: https://data.texas.gov/download/eiei-9rpf/application/octet-stream
+    trip_updates_url: "https://data.texas.gov/download/rmk2-acnw/application/octet-stream"
+    db_path: capmetro.boltdb
+    interval: 15s      # a string
+    timeout: 20        # seconds
+    retention: 90d
+    archive_raw: yes
+    headers:
+      X-Api-Key: secret
+    notifiers:
+      - type: webhook
+        url: https://example.com/hooks/capmetricsd
+        events:
+          - fail
+    fail_after: 3
+  - name: other-agency
+    vehicle_positions_url: https://example.com/other/vehicle_positions.pb
+    db_path: other-agency.boltdb
+`
+
+const jsonConfig = `{
+  "http_addr": ":8080",
+  "feeds": [
+    {
+      "name": "capmetro",
+      "vehicle_positions_url": "https://data.texas.gov/download/eiei-9rpf/application/octet-stream",
+      "trip_updates_url": "https://data.texas.gov/download/rmk2-acnw/application/octet-stream",
+      "db_path": "capmetro.boltdb",
+      "interval": "15s",
+      "timeout": 20,
+      "retention": "90d",
+      "archive_raw": true,
+      "headers": {"X-Api-Key": "secret"},
+      "notifiers": [{"type": "webhook", "url": "https://example.com/hooks/capmetricsd", "events": ["fail"]}],
+      "fail_after": 3
+    },
+    {
+      "name": "other-agency",
+      "vehicle_positions_url": "https://example.com/other/vehicle_positions.pb",
+      "db_path": "other-agency.boltdb"
+    }
+  ]
+}`
+
+// writeConfig writes a config file to a temporary directory, which is removed
+// by the returned func.
+func writeConfig(t *testing.T, name, config string) (string, func()) {
+	dir, err := ioutil.TempDir("", "capmetricsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path, cleanup := writeConfig(t, "feeds.yaml", yamlConfig)
+	defer cleanup()
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HTTPAddr != ":8080" || len(config.Feeds) != 2 {
+		t.Fatalf("got %+v", config)
+	}
+	feed := config.Feeds[0]
+	if feed.Name != "capmetro" || feed.DBPath != "capmetro.boltdb" || !strings.HasSuffix(feed.TripUpdatesURL, "rmk2-acnw/application/octet-stream") {
+		t.Errorf("got feed %+v", feed)
+	}
+	if feed.Interval.Duration != 15*time.Second {
+		t.Errorf("got interval %s, want 15s", feed.Interval)
+	}
+	if feed.Timeout.Duration != 20*time.Second {
+		t.Errorf("got timeout %s, want 20s", feed.Timeout)
+	}
+	if feed.Retention.Duration != 90*24*time.Hour {
+		t.Errorf("got retention %s, want 90 days", feed.Retention)
+	}
+	if !feed.ArchiveRaw {
+		t.Error("archive_raw: yes wasn't read as true")
+	}
+	if feed.Headers["X-Api-Key"] != "secret" {
+		t.Errorf("got headers %v", feed.Headers)
+	}
+	if len(feed.Notifiers) != 1 || feed.Notifiers[0].Type != NOTIFIER_WEBHOOK || !reflect.DeepEqual(feed.Notifiers[0].Events, []string{NOTIFY_FAIL}) {
+		t.Errorf("got notifiers %+v", feed.Notifiers)
+	}
+	if feed.FailAfter != 3 || config.Feeds[1].FailAfter != 1 {
+		t.Errorf("got fail_after %d and %d, want 3 and the default of 1", feed.FailAfter, config.Feeds[1].FailAfter)
+	}
+
+	jsonPath, cleanup := writeConfig(t, "feeds.json", jsonConfig)
+	defer cleanup()
+	want, err := LoadConfig(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// notifiers are built from the config, so they're compared by their
+	// config instead
+	for i := range config.Feeds {
+		config.Feeds[i].notifiers, want.Feeds[i].notifiers = nil, nil
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("YAML config\n%+v\ndoesn't match the same JSON config\n%+v", config, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	configs := []struct {
+		name, config string
+	}{
+		{"feeds.yml", "feeds:\n  - name: capmetro\n    db_path: [unclosed\n"},
+		{"feeds.yml", "feeds:\n  - name: capmetro\n    db_path: capmetro.boltdb\n"},
+		{"feeds.yaml", "feeds:\n  - name: capmetro\n    vehicle_positions_url: https://example.com/vp.pb\n    db_path: capmetro.boltdb\n    interval: soon\n"},
+		{"feeds.yaml", "feeds:\n  - name: capmetro\n    vehicle_positions_url: https://example.com/vp.pb\n    db_path: capmetro.boltdb\n    headers:\n      [a, b]: c\n"},
+		// YAML is only read from files named like it
+		{"feeds.json", "feeds:\n  - name: capmetro\n    vehicle_positions_url: https://example.com/vp.pb\n    db_path: capmetro.boltdb\n"},
+	}
+	for _, c := range configs {
+		path, cleanup := writeConfig(t, c.name, c.config)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("no error loading %s:\n%s", c.name, c.config)
+		}
+		cleanup()
+	}
+}
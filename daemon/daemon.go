@@ -1,63 +1,607 @@
 package daemon
 
 import (
+	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 const (
-	LOG_INTERVAL   = 30 * time.Second
-	BUCKET_NAME    = "vehicle_locations"
-	ISO8601_FORMAT = "2006-01-02T15:04:05-07:00"
+	// LOG_INTERVAL is the default interval between captures of a feed.
+	LOG_INTERVAL = 30 * time.Second
+	// OPEN_TIMEOUT is how long to wait for another process to release a
+	// database before giving up on a capture.
+	OPEN_TIMEOUT = 10 * time.Second
+
+	BUCKET_NAME               = "vehicle_locations"
+	TRIP_UPDATES_BUCKET_NAME  = "trip_updates"
+	ALERTS_BUCKET_NAME        = "alerts"
+	ALERT_ROUTES_BUCKET_NAME  = "alert_routes"
+	TIME_INDEX_BUCKET_NAME    = "index_time"
+	ROUTE_INDEX_BUCKET_NAME   = "index_route"
+	VEHICLE_INDEX_BUCKET_NAME = "index_vehicle"
+	META_BUCKET_NAME          = "meta"
+	RAW_FEEDS_BUCKET_NAME     = "raw_feeds"
+	ISO8601_FORMAT            = "2006-01-02T15:04:05-07:00"
 )
 
 var (
-	dlog           = log.New(os.Stdout, "[DBG] ", log.LstdFlags|log.Lshortfile)
-	elog           = log.New(os.Stderr, "[ERR] ", log.LstdFlags|log.Lshortfile)
-	cronitorClient = http.Client{Timeout: 10 * time.Second}
+	dlog = log.New(os.Stdout, "[DBG] ", log.LstdFlags|log.Lshortfile)
+	elog = log.New(os.Stderr, "[ERR] ", log.LstdFlags|log.Lshortfile)
 )
 
-func captureLocations(target, dbPath, cronitorURL string) {
-	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: LOG_INTERVAL})
+// feed holds the state of a single feed while it's being captured.
+type feed struct {
+	FeedConfig
+	fetcher *Fetcher
+	// mu is held by each capture, and by compaction while it swaps db for
+	// the compacted database
+	mu       sync.Mutex
+	db       *bolt.DB
+	archive  *Archive
+	lastSync time.Time
+	schedule *schedule
+	metrics  *feedMetrics
+	systemd  *systemdNotifier
+	// failures counts the captures which have failed in a row.
+	failures int
+	// lastErr and lastStats describe the last capture to notifiers.
+	lastErr   error
+	lastStats *LocationStats
+	// queues send events to each of the notifiers, started by the first
+	// event.
+	queues []*notifierQueue
+	// lastPrune is when data older than the feed's retention period was
+	// last pruned, read from the database the first time it's needed.
+	lastPrune time.Time
+	// pruning is closed once a prune running alongside captures is done, and
+	// is nil if none is running.
+	pruning chan struct{}
+}
+
+func newFeed(config FeedConfig) *feed {
+	f := &feed{
+		FeedConfig: config,
+		fetcher:    NewFetcher(config.FetcherConfig),
+		lastSync:   time.Now(),
+		schedule:   newSchedule(config),
+		metrics:    newFeedMetrics(config),
+	}
+	f.fetcher.metrics = f.metrics
+	return f
+}
+
+// open opens the feed's database, unless it's already open, and keeps it open
+// until the feed is stopped.
+func (f *feed) open() error {
+	if f.db != nil {
+		return nil
+	}
+
+	db, err := f.openDB(f.DBPath)
 	if err != nil {
-		elog.Println("Error opening BoltDB: ", err.Error())
+		return err
+	}
+	if err = PrepareDB(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	f.db = db
+	f.archive = newArchive(f.Name, f.DBPath, db)
+	registerArchive(f.archive)
+	return nil
+}
+
+func (f *feed) openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = f.fsync.noSync()
+	return db, nil
+}
+
+// close flushes any writes which haven't been fsynced and closes the feed's
+// database, once queries still reading it have finished.
+func (f *feed) close() {
+	if f.db == nil {
 		return
 	}
-	defer db.Close()
 
-	if err = CaptureLocations(target, db); err != nil {
-		elog.Println(err)
-		// if error is returned while recording location, don't notify cronitor
+	unregisterArchive(f.Name)
+	f.archive.replace(nil)()
+	if f.db.NoSync {
+		if err := f.db.Sync(); err != nil {
+			elog.Printf("[%s] Error syncing BoltDB: %s\n", f.Name, err)
+		}
+	}
+	if err := f.db.Close(); err != nil {
+		elog.Printf("[%s] Error closing BoltDB: %s\n", f.Name, err)
+	}
+	f.db, f.archive = nil, nil
+}
+
+// capture captures each of the feed's URLs, returning the outcome for the
+// first of them, which the feed's schedule follows.
+func (f *feed) capture() (outcome captureOutcome) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// a panic while capturing one feed shouldn't take down the others
+	defer func() {
+		if r := recover(); r != nil {
+			elog.Printf("[%s] Recovered from panic during capture: %v\n", f.Name, r)
+			f.lastErr = fmt.Errorf("panic during capture: %v", r)
+			outcome = captureFailed
+		}
+	}()
+
+	f.lastErr, f.lastStats = nil, nil
+
+	// if the database couldn't be opened (e.g. another process has it locked),
+	// try again next time
+	if err := f.open(); err != nil {
+		elog.Printf("[%s] Error opening BoltDB: %s\n", f.Name, err.Error())
+		f.lastErr = fmt.Errorf("Error opening BoltDB: %s", err)
+		return captureFailed
+	}
+	defer f.sync()
+
+	dlog.Printf("[%s] Capturing feed\n", f.Name)
+
+	// if an error is returned while recording data, the capture has failed
+	if f.VehiclePositionsURL != "" {
+		stats, err := CaptureLocations(f.fetcher, f.VehiclePositionsURL, f.db, f.DeadLetterPath, f.ArchiveRaw)
+		f.metrics.locations(stats)
+		if stats.Seen > 0 {
+			f.lastStats = &stats
+		}
+		f.metrics.headerTime(RAW_VEHICLE_POSITIONS, f.fetcher.lastHeaderTime(RAW_VEHICLE_POSITIONS, f.VehiclePositionsURL))
+		if f.failed(RAW_VEHICLE_POSITIONS, err) {
+			return captureFailed
+		}
+		outcome = outcomeOf(err, stats.Valid == 0)
+	}
+
+	if f.TripUpdatesURL != "" {
+		err := CaptureTripUpdates(f.fetcher, f.TripUpdatesURL, f.db, f.ArchiveRaw)
+		f.metrics.headerTime(RAW_TRIP_UPDATES, f.fetcher.lastHeaderTime(RAW_TRIP_UPDATES, f.TripUpdatesURL))
+		if f.failed(RAW_TRIP_UPDATES, err) {
+			return captureFailed
+		}
+		if outcome == captureNone {
+			outcome = outcomeOf(err, false)
+		}
+	}
+
+	if f.AlertsURL != "" {
+		err := CaptureAlerts(f.fetcher, f.AlertsURL, f.db, f.ArchiveRaw)
+		f.metrics.headerTime(RAW_ALERTS, f.fetcher.lastHeaderTime(RAW_ALERTS, f.AlertsURL))
+		if f.failed(RAW_ALERTS, err) {
+			return captureFailed
+		}
+		if outcome == captureNone {
+			outcome = outcomeOf(err, false)
+		}
+	}
+
+	return
+}
+
+// outcomeOf returns the outcome of capturing a feed which didn't fail.
+func outcomeOf(err error, empty bool) captureOutcome {
+	switch {
+	case err == ErrNotModified || err == ErrStaleFeed:
+		return captureUnchanged
+	case empty:
+		return captureIdle
+	}
+	return captureUpdated
+}
+
+// primaryURL returns the first of the feed's URLs and its kind, which the
+// feed's schedule follows.
+func (f *feed) primaryURL() (kind, url string) {
+	switch {
+	case f.VehiclePositionsURL != "":
+		return RAW_VEHICLE_POSITIONS, f.VehiclePositionsURL
+	case f.TripUpdatesURL != "":
+		return RAW_TRIP_UPDATES, f.TripUpdatesURL
+	}
+	return RAW_ALERTS, f.AlertsURL
+}
+
+// failed reports whether capturing a kind of feed failed, logging the error.
+// A feed which was skipped because it hadn't changed isn't a failure, it's
+// counted in the feed's metrics instead.
+func (f *feed) failed(kind string, err error) bool {
+	var notModified, stale int
+	switch err {
+	case nil:
+		return false
+	case ErrNotModified:
+		notModified, stale = f.metrics.skip(kind, SKIP_NOT_MODIFIED)
+	case ErrStaleFeed:
+		notModified, stale = f.metrics.skip(kind, SKIP_STALE)
+	default:
+		if _, ok := err.(*decodeError); ok {
+			f.metrics.decodeError(kind)
+		}
+		elog.Printf("[%s] %s\n", f.Name, err)
+		f.lastErr = err
+		return true
+	}
+
+	dlog.Printf("[%s] Skipped %s feed, %s (%d not modified and %d stale so far)\n", f.Name, kind, err, notModified, stale)
+	return false
+}
+
+// sync flushes writes committed without fsync to disk once the feed's fsync
+// interval has passed.
+func (f *feed) sync() {
+	if f.fsync.interval <= 0 || time.Since(f.lastSync) < f.fsync.interval {
+		return
+	}
+
+	if err := f.db.Sync(); err != nil {
+		elog.Printf("[%s] Error syncing BoltDB: %s\n", f.Name, err)
+		return
+	}
+	f.lastSync = time.Now()
+}
+
+// prune deletes data older than the feed's retention period, then compacts
+// its database if enough of it was freed, so the space is returned to the
+// filesystem. It runs alongside captures, which only wait for compaction to
+// catch up with what they wrote while the database was being copied.
+func (f *feed) prune(db *bolt.DB) {
+	done := f.systemd.busy(fmt.Sprintf("Pruning %s", f.Name))
+	defer done()
+
+	cutoff := time.Now().Add(-f.Retention.Duration)
+	log.Printf("[%s] Pruning data from before %s\n", f.Name, cutoff.Format(ISO8601_FORMAT))
+	start := time.Now()
+	stats, err := Prune(db, cutoff.Unix())
+	if err != nil {
+		elog.Printf("[%s] Error pruning BoltDB: %s\n", f.Name, err)
+		return
+	}
+	log.Printf("[%s] Pruned %s in %s\n", f.Name, stats, time.Now().Sub(start))
+
+	info, err := os.Stat(f.DBPath)
+	if err != nil {
+		elog.Printf("[%s] Error checking size of BoltDB: %s\n", f.Name, err)
+		return
+	}
+	free := FreeSpace(db)
+	if float64(free) < COMPACT_MIN_FREE*float64(info.Size()) {
+		dlog.Printf("[%s] Not compacting BoltDB, only %d of %d bytes are free\n", f.Name, free, info.Size())
 		return
 	}
 
-	notifyCronitor(cronitorURL)
+	start = time.Now()
+	if err = f.compact(db); err != nil {
+		elog.Printf("[%s] Error compacting BoltDB: %s\n", f.Name, err)
+		return
+	}
+	before := info.Size()
+	if info, err = os.Stat(f.DBPath); err == nil {
+		log.Printf("[%s] Compacted BoltDB from %d to %d bytes in %s\n", f.Name, before, info.Size(), time.Now().Sub(start))
+	}
 }
 
-func notifyCronitor(cronitorURL string) {
-	if cronitorURL != "" {
-		res, err := cronitorClient.Get(cronitorURL)
+// compact copies the feed's database to a new file while it's still being
+// captured and queried. Captures are then paused while the copy catches up
+// with what they wrote in the meantime, and it replaces the database. The old
+// database is closed once the queries reading it have finished.
+func (f *feed) compact(db *bolt.DB) (err error) {
+	// a copy left by a compaction which was interrupted is incomplete
+	tmpPath := f.DBPath + ".compact"
+	if err = os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = Compact(db, tmpPath); err != nil {
+		return
+	}
+	compacted, err := f.openDB(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	f.mu.Lock()
+	paused := time.Now()
+	count, err := CatchUp(db, compacted)
+	if err == nil {
+		err = compacted.Sync()
+	}
+	if err == nil {
+		// the compacted database's handle follows it to its new name
+		err = os.Rename(tmpPath, f.DBPath)
+	}
+	if err != nil {
+		f.mu.Unlock()
+		compacted.Close()
+		os.Remove(tmpPath)
+		return
+	}
+	f.db = compacted
+	wait := f.archive.replace(compacted)
+	f.mu.Unlock()
+	log.Printf("[%s] Captures were paused for %s while compacting caught up with %d writes\n", f.Name, time.Now().Sub(paused), count)
+
+	wait()
+	if err = db.Close(); err != nil {
+		elog.Printf("[%s] Error closing BoltDB from before compacting: %s\n", f.Name, err)
+	}
+	return nil
+}
+
+// startPrune starts pruning the feed's database alongside its captures, if
+// it's due and isn't already being pruned.
+func (f *feed) startPrune() {
+	if f.pruning != nil {
+		select {
+		case <-f.pruning:
+			f.pruning = nil
+		default:
+			return
+		}
+	}
+	if !f.pruneDue() {
+		return
+	}
+	f.lastPrune = time.Now()
+	if err := f.open(); err != nil {
+		elog.Printf("[%s] Error opening BoltDB: %s\n", f.Name, err.Error())
+		return
+	}
+
+	done := make(chan struct{})
+	f.pruning = done
+	go func(db *bolt.DB) {
+		defer close(done)
+		f.prune(db)
+	}(f.db)
+}
+
+// waitForPrune waits for a prune started by startPrune to finish.
+func (f *feed) waitForPrune() {
+	if f.pruning == nil {
+		return
+	}
+	select {
+	case <-f.pruning:
+	default:
+		log.Printf("[%s] Waiting for pruning to finish\n", f.Name)
+		<-f.pruning
+	}
+	f.pruning = nil
+}
+
+// pruneDue reports whether the feed's database is due to be pruned. When it
+// was last pruned is kept in the database, so restarting or reloading the
+// daemon doesn't prune it again any sooner.
+func (f *feed) pruneDue() bool {
+	if f.Retention.Duration <= 0 {
+		return false
+	}
+	if f.lastPrune.IsZero() {
+		if err := f.open(); err != nil {
+			return false
+		}
+		pruned, err := LastPruned(f.db)
 		if err != nil {
-			elog.Printf("Error notifying Cronitor: %s\n", err.Error())
+			elog.Printf("[%s] Error reading when BoltDB was last pruned: %s\n", f.Name, err)
+		}
+		if pruned.IsZero() {
+			// never pruned, so it's due now
+			return true
+		}
+		f.lastPrune = pruned
+	}
+	return time.Since(f.lastPrune) >= PRUNE_INTERVAL
+}
+
+// notify queues an event for each of the feed's notifiers, which send it in
+// the background, logging any errors.
+func (f *feed) notify(event *CaptureEvent) {
+	if f.queues == nil {
+		for _, notifier := range f.notifiers {
+			f.queues = append(f.queues, newNotifierQueue(f.Name, notifier))
+		}
+	}
+	for _, q := range f.queues {
+		q.send(event)
+	}
+}
+
+// stopNotifiers waits up to NOTIFY_TIMEOUT for the events queued for the
+// feed's notifiers to be sent, then stops their queues.
+func (f *feed) stopNotifiers() {
+	for _, q := range f.queues {
+		close(q.events)
+	}
+	timeout := time.After(NOTIFY_TIMEOUT)
+	for _, q := range f.queues {
+		select {
+		case <-q.done:
+		case <-timeout:
+			elog.Printf("[%s] Gave up waiting for notifications to be sent\n", f.Name)
+			f.queues = nil
 			return
 		}
-		res.Body.Close()
 	}
+	f.queues = nil
+}
+
+// report notifies the feed's notifiers of the outcome of a capture. Failures
+// are only reported once FailAfter captures have failed in a row, and then
+// not again until a capture succeeds.
+func (f *feed) report(outcome captureOutcome, start time.Time) {
+	event := &CaptureEvent{
+		Feed:          f.Name,
+		Event:         NOTIFY_SUCCESS,
+		Outcome:       outcome.String(),
+		Started:       start,
+		Duration:      int64(time.Since(start) / time.Millisecond),
+		Locations:     f.lastStats,
+		FeedTimestamp: f.fetcher.lastHeaderTime(f.primaryURL()),
+	}
+	if f.lastErr != nil {
+		event.Error = f.lastErr.Error()
+	}
+	if outcome == captureFailed {
+		f.failures++
+		event.Event = NOTIFY_FAIL
+		event.ConsecutiveFailures = f.failures
+	} else {
+		f.failures = 0
+	}
+
+	// systemd's status follows every capture, whatever FailAfter is
+	if err := f.systemd.Notify(event); err != nil {
+		elog.Printf("[%s] Error notifying systemd: %s\n", f.Name, err)
+	}
+
+	if f.failures == 0 {
+		f.notify(event)
+		return
+	}
+	if f.failures != f.FailAfter {
+		return
+	}
+	elog.Printf("[%s] %d captures in a row have failed\n", f.Name, f.failures)
+	f.notify(event)
 }
 
-func Start(target, cronitorURL, dbPath string) {
-	captureLocations(target, dbPath, cronitorURL)
+// run captures the feed on its schedule until stop is closed, then closes its
+// database. A capture in progress when stop is closed is allowed to finish.
+// Intervals are measured from the start of each capture, so a slow capture
+// doesn't push back the ones after it.
+func (f *feed) run(stop <-chan struct{}) {
+	defer f.close()
+	// a prune in progress has to finish before the database is closed
+	defer f.waitForPrune()
+	defer f.stopNotifiers()
 
-	ticker := time.Tick(LOG_INTERVAL)
+	registerMetrics(f.metrics)
+	defer unregisterMetrics(f.Name)
 
 	for {
+		start := time.Now()
+		f.notify(&CaptureEvent{Feed: f.Name, Event: NOTIFY_START, Started: start, ConsecutiveFailures: f.failures})
+		outcome := f.capture()
+		f.report(outcome, start)
+		f.startPrune()
+
+		interval := f.schedule.next(outcome, f.fetcher.lastHeaderTime(f.primaryURL()), time.Now())
+		f.metrics.captured(outcome, interval)
+		if f.schedule.adaptive {
+			dlog.Printf("[%s] Feed %s, next capture in %s\n", f.Name, outcome, interval)
+		}
+
+		timer := time.NewTimer(interval - time.Since(start))
 		select {
-		case <-ticker:
-			captureLocations(target, dbPath, cronitorURL)
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// feedGroup is a set of feeds being captured concurrently.
+type feedGroup struct {
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func startFeeds(config *Config, systemd *systemdNotifier) *feedGroup {
+	group := &feedGroup{stopCh: make(chan struct{})}
+
+	for _, fc := range config.Feeds {
+		f := newFeed(fc)
+		f.systemd = systemd
+		log.Printf("Starting feed %s -- vehicle positions: %s, trip updates: %s, alerts: %s, dbPath: %s, schedule: %s, fsync: %s, archive raw feeds: %t, retention: %s, cronitor URL: %s, notifiers: %d (failures reported after %d in a row)\n",
+			fc.Name, fc.VehiclePositionsURL, fc.TripUpdatesURL, fc.AlertsURL, fc.DBPath, f.schedule, fc.fsync, fc.ArchiveRaw, fc.Retention, fc.CronitorURL, len(fc.Notifiers), fc.FailAfter)
+
+		group.wg.Add(1)
+		go func(f *feed) {
+			defer group.wg.Done()
+			f.run(group.stopCh)
+		}(f)
+	}
+
+	return group
+}
+
+// stop signals every feed to stop and waits for in-flight captures to finish.
+func (g *feedGroup) stop() {
+	close(g.stopCh)
+	g.wg.Wait()
+}
+
+// Start captures every feed returned by load concurrently, each on its own
+// schedule. On SIGHUP the config is loaded again and the feeds are restarted
+// with their new settings. On SIGINT or SIGTERM, services reading from the
+// feeds' databases, like the HTTP API, are closed, in-flight captures are
+// allowed to finish and Start returns. When run by systemd as a Type=notify
+// service, the daemon reports itself ready once a feed has been captured, and
+// pings systemd's watchdog after each capture.
+func Start(load func() (*Config, error), services ...io.Closer) error {
+	config, err := load()
+	if err != nil {
+		return err
+	}
+	if err = config.Validate(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	systemd := newSystemdNotifier()
+	group := startFeeds(config, systemd)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %s, waiting for captures in progress to finish\n", sig)
+			systemd.stopping()
+			for _, service := range services {
+				if err := service.Close(); err != nil {
+					elog.Println(err)
+				}
+			}
+			group.stop()
+			log.Println("Stopped capmetrics daemon")
+			return nil
+		}
+
+		log.Println("Received SIGHUP, reloading config")
+		config, err := load()
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			elog.Printf("Error reloading config, keeping the current one: %s\n", err)
+			continue
 		}
+
+		systemd.reloading()
+		group.stop()
+		group = startFeeds(config, systemd)
+		systemd.reloaded()
 	}
+
+	return nil
 }
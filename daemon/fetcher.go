@@ -0,0 +1,311 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// FETCH_TIMEOUT is how long a feed can take to download by default.
+	FETCH_TIMEOUT = 30 * time.Second
+	// FETCH_ATTEMPTS is how many times a feed is requested by default before
+	// giving up.
+	FETCH_ATTEMPTS = 3
+	// FETCH_BACKOFF is the delay before the first retry, which doubles with
+	// each attempt and is jittered by up to half either way.
+	FETCH_BACKOFF = time.Second
+)
+
+var (
+	// ErrNotModified is returned by Fetcher.Get when the server reports a feed
+	// hasn't changed since it was last captured.
+	ErrNotModified = errors.New("feed not modified since it was last captured")
+	// ErrStaleFeed is returned by Fetcher.Get when a feed's header timestamp
+	// is no newer than that of the feed last captured from the same URL.
+	ErrStaleFeed = errors.New("feed is no newer than the last one captured")
+)
+
+// FetcherConfig describes how a feed's producer expects it to be requested.
+type FetcherConfig struct {
+	// Timeout limits each request, including reading the feed.
+	Timeout Duration `json:"timeout"`
+	// Attempts is how many times a request is made before giving up. Only
+	// network errors and 5xx or 429 responses are retried.
+	Attempts int `json:"attempts"`
+	// Headers are added to every request, e.g. for API keys.
+	Headers map[string]string `json:"headers"`
+	// QueryParams are added to the query string of every request, for
+	// producers which expect API keys there.
+	QueryParams map[string]string `json:"query_params"`
+	// ProxyURL is the proxy to send requests through. By default the proxy
+	// given by the HTTP_PROXY and HTTPS_PROXY environment variables is used.
+	ProxyURL string `json:"proxy_url"`
+	// TLSCert and TLSKey are the paths of a PEM encoded client certificate
+	// and key, for producers which require mutual TLS. TLSCA is the path of
+	// PEM encoded CA certificates to verify the producer with, instead of the
+	// system's.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	TLSCA   string `json:"tls_ca"`
+
+	proxy     *url.URL
+	tlsConfig *tls.Config
+}
+
+// validate fills in defaults, and loads the proxy URL and TLS files so
+// mistakes are reported when the config is loaded.
+func (c *FetcherConfig) validate() error {
+	if c.Timeout.Duration < 0 {
+		return fmt.Errorf("invalid timeout: %s", c.Timeout)
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = FETCH_TIMEOUT
+	}
+	if c.Attempts < 0 {
+		return fmt.Errorf("invalid number of attempts: %d", c.Attempts)
+	}
+	if c.Attempts == 0 {
+		c.Attempts = FETCH_ATTEMPTS
+	}
+
+	c.proxy = nil
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("invalid proxy URL: %s", c.ProxyURL)
+		}
+		c.proxy = proxy
+	}
+
+	c.tlsConfig = nil
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be given together")
+	}
+	if c.TLSCert == "" && c.TLSCA == "" {
+		return nil
+	}
+
+	c.tlsConfig = &tls.Config{}
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		c.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return fmt.Errorf("Error loading CA certificates: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.TLSCA)
+		}
+		c.tlsConfig.RootCAs = pool
+	}
+	return nil
+}
+
+// fetchKey identifies a feed by its kind and URL, since some producers serve
+// several kinds of feed from the same URL.
+type fetchKey struct {
+	kind string
+	url  string
+}
+
+// fetchState is what's known about the last feed fetched from a URL.
+type fetchState struct {
+	etag         string
+	lastModified string
+	// headerTime is the timestamp of the feed's header, or 0 if it has none.
+	headerTime int64
+}
+
+// Fetcher downloads GTFS-realtime feeds, adding any headers or query
+// parameters the producer requires (e.g. API keys) to every request. It
+// remembers the last feed captured from each URL so unchanged feeds can be
+// skipped.
+type Fetcher struct {
+	Client      *http.Client
+	Headers     map[string]string
+	QueryParams map[string]string
+	Attempts    int
+
+	// fetched holds the state of the last feed returned by Get for each URL,
+	// and captured that of the last one marked as captured.
+	fetched  map[fetchKey]fetchState
+	captured map[fetchKey]fetchState
+	// metrics records every request, if set.
+	metrics *feedMetrics
+}
+
+// NewFetcher returns a Fetcher for a validated config.
+func NewFetcher(config FetcherConfig) *Fetcher {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     config.tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if config.proxy != nil {
+		transport.Proxy = http.ProxyURL(config.proxy)
+	}
+
+	attempts := config.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	return &Fetcher{
+		Client:      &http.Client{Transport: transport, Timeout: config.Timeout.Duration},
+		Headers:     config.Headers,
+		QueryParams: config.QueryParams,
+		Attempts:    attempts,
+		fetched:     map[fetchKey]fetchState{},
+		captured:    map[fetchKey]fetchState{},
+	}
+}
+
+// fetchError is an error downloading a feed, which may be worth retrying.
+type fetchError struct {
+	err       error
+	retryable bool
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+// Get downloads the feed of the given kind at url, retrying with jittered exponential backoff
+// if the request fails with a network error or a 5xx or 429 response. Once a
+// feed from url has been captured, the request is made conditional on the
+// feed having changed since, and ErrNotModified is returned if the server
+// reports it hasn't. ErrStaleFeed is returned if the feed downloaded is no
+// newer than the one captured, and later requests are made conditional on it
+// instead.
+func (f *Fetcher) Get(kind, url string) (pb []byte, err error) {
+	key := fetchKey{kind, url}
+	start := time.Now()
+
+	backoff := FETCH_BACKOFF
+	for attempt := 1; ; attempt++ {
+		pb, err = f.get(key)
+		fe, ok := err.(*fetchError)
+		if !ok || !fe.retryable || attempt >= f.Attempts {
+			break
+		}
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		elog.Printf("Error fetching feed (attempt %d of %d), retrying in %s: %s\n", attempt, f.Attempts, delay, err)
+		time.Sleep(delay)
+		backoff *= 2
+	}
+	if err != nil {
+		return
+	}
+
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed downloading PB file: %.0fms\n", end.Seconds()*1000)
+
+	if state := f.fetched[key]; state.headerTime > 0 && state.headerTime <= f.captured[key].headerTime {
+		// nothing is captured from a stale feed, but the next request is
+		// made conditional on it so it isn't downloaded again
+		captured := f.captured[key]
+		captured.etag, captured.lastModified = state.etag, state.lastModified
+		f.captured[key] = captured
+		return nil, ErrStaleFeed
+	}
+	return
+}
+
+// get makes a single request for a feed.
+func (f *Fetcher) get(key fetchKey) (pb []byte, err error) {
+	rawURL := key.url
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return
+	}
+	if len(f.QueryParams) > 0 {
+		query := req.URL.Query()
+		for name, value := range f.QueryParams {
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	for name, value := range f.Headers {
+		req.Header.Set(name, value)
+	}
+
+	last := f.captured[key]
+	if last.etag != "" {
+		req.Header.Set("If-None-Match", last.etag)
+	}
+	if last.lastModified != "" {
+		req.Header.Set("If-Modified-Since", last.lastModified)
+	}
+
+	start := time.Now()
+	code := "error"
+	defer func() {
+		f.metrics.fetched(key.kind, code, time.Since(start))
+	}()
+
+	res, err := f.Client.Do(req)
+	if err != nil {
+		// errors include the URL requested, which shouldn't leak API keys
+		// from the query string into the logs
+		if ue, ok := err.(*url.Error); ok {
+			ue.URL = rawURL
+		}
+		return nil, &fetchError{err: err, retryable: true}
+	}
+	defer res.Body.Close()
+	code = strconv.Itoa(res.StatusCode)
+
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		return nil, ErrNotModified
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		retryable := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return nil, &fetchError{err: fmt.Errorf("unexpected status fetching %s: %s", rawURL, res.Status), retryable: retryable}
+	}
+
+	pb, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &fetchError{err: err, retryable: true}
+	}
+
+	state := fetchState{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+	if ts, ok := feedHeaderTime(pb); ok {
+		state.headerTime = ts
+	}
+	f.fetched[key] = state
+	return
+}
+
+// lastHeaderTime returns the header timestamp of the last feed of a kind
+// captured from url, or 0 if it's unknown.
+func (f *Fetcher) lastHeaderTime(kind, url string) int64 {
+	return f.captured[fetchKey{kind, url}].headerTime
+}
+
+// Captured records that the feed of the given kind last returned by Get for
+// url has been captured. Until it's called, the same feed is fetched and
+// returned again, so a feed which couldn't be stored is retried.
+func (f *Fetcher) Captured(kind, url string) {
+	key := fetchKey{kind, url}
+	if state, ok := f.fetched[key]; ok {
+		f.captured[key] = state
+	}
+}
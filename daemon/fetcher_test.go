@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+func TestStaleFeedIsNotDownloadedAgain(t *testing.T) {
+	// the producer serves a feed with header time 100, then an older one
+	// with header time 90, under a new ETag
+	feeds := map[string]int64{"a": 100, "b": 90}
+	etag := "a"
+	var conditions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fm := &gtfsrt.FeedMessage{Header: &gtfsrt.FeedHeader{
+			GtfsRealtimeVersion: proto.String("1.0"),
+			Timestamp:           proto.Uint64(uint64(feeds[etag])),
+		}}
+		w.Header().Set("ETag", etag)
+		w.Write(marshal(t, fm))
+	}))
+	defer server.Close()
+
+	f := NewFetcher(FetcherConfig{})
+	if _, err := f.Get(RAW_VEHICLE_POSITIONS, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	f.Captured(RAW_VEHICLE_POSITIONS, server.URL)
+
+	etag = "b"
+	if _, err := f.Get(RAW_VEHICLE_POSITIONS, server.URL); err != ErrStaleFeed {
+		t.Fatalf("got %v fetching an older feed, want ErrStaleFeed", err)
+	}
+	if _, err := f.Get(RAW_VEHICLE_POSITIONS, server.URL); err != ErrNotModified {
+		t.Errorf("got %v fetching the older feed again, want ErrNotModified", err)
+	}
+	if got := f.lastHeaderTime(RAW_VEHICLE_POSITIONS, server.URL); got != 100 {
+		t.Errorf("last header time is %d after a stale feed, want 100", got)
+	}
+	if fmt.Sprint(conditions) != "[ a b]" {
+		t.Errorf("got If-None-Match headers %q, want none, a then b", conditions)
+	}
+}
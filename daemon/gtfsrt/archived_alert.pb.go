@@ -0,0 +1,64 @@
+// Code generated by protoc-gen-go.
+// source: archived_alert.proto
+// DO NOT EDIT!
+
+package gtfsrt
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type ArchivedAlert struct {
+	Id       *string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	EntityId *string `protobuf:"bytes,2,opt,name=entity_id" json:"entity_id,omitempty"`
+	// seconds since the epoch
+	FirstSeen        *int64 `protobuf:"varint,3,opt,name=first_seen" json:"first_seen,omitempty"`
+	LastSeen         *int64 `protobuf:"varint,4,opt,name=last_seen" json:"last_seen,omitempty"`
+	Alert            *Alert `protobuf:"bytes,5,opt,name=alert" json:"alert,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ArchivedAlert) Reset()         { *m = ArchivedAlert{} }
+func (m *ArchivedAlert) String() string { return proto.CompactTextString(m) }
+func (*ArchivedAlert) ProtoMessage()    {}
+
+func (m *ArchivedAlert) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *ArchivedAlert) GetEntityId() string {
+	if m != nil && m.EntityId != nil {
+		return *m.EntityId
+	}
+	return ""
+}
+
+func (m *ArchivedAlert) GetFirstSeen() int64 {
+	if m != nil && m.FirstSeen != nil {
+		return *m.FirstSeen
+	}
+	return 0
+}
+
+func (m *ArchivedAlert) GetLastSeen() int64 {
+	if m != nil && m.LastSeen != nil {
+		return *m.LastSeen
+	}
+	return 0
+}
+
+func (m *ArchivedAlert) GetAlert() *Alert {
+	if m != nil {
+		return m.Alert
+	}
+	return nil
+}
+
+func init() {
+}
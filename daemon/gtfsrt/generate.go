@@ -0,0 +1,7 @@
+package gtfsrt
+
+// The messages are generated with protoc-gen-go built from
+// github.com/golang/protobuf 34a5f244f1c0, the nearest upstream revision to the
+// vendored proto package. Every file is generated at once, since files
+// generated separately import each other as different packages.
+//go:generate protoc --go_out=. gtfs_realtime.proto stop_time_prediction.proto archived_alert.proto vehicle_location.proto
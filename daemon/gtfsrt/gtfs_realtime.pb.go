@@ -1,26 +1,31 @@
 // Code generated by protoc-gen-go.
-// source: gtfs-realtime.proto
+// source: gtfs_realtime.proto
 // DO NOT EDIT!
 
 /*
-Package gtfs_realtime is a generated protocol buffer package.
+Package gtfsrt is a generated protocol buffer package.
 
 It is generated from these files:
-    gtfs_realtime.proto
+
+	gtfs_realtime.proto
+	stop_time_prediction.proto
+	archived_alert.proto
+	vehicle_location.proto
 
 It has these top-level messages:
-    FeedMessage
-    FeedHeader
-    FeedEntity
-    TripUpdate
-    VehiclePosition
-    Alert
-    TimeRange
-    Position
-    TripDescriptor
-    VehicleDescriptor
-    EntitySelector
-    TranslatedString
+
+	FeedMessage
+	FeedHeader
+	FeedEntity
+	TripUpdate
+	VehiclePosition
+	Alert
+	TimeRange
+	Position
+	TripDescriptor
+	VehicleDescriptor
+	EntitySelector
+	TranslatedString
 */
 package gtfsrt
 
@@ -247,8 +252,8 @@ var VehiclePosition_OccupancyStatus_value = map[string]int32{
 	"FEW_SEATS_AVAILABLE":        2,
 	"STANDING_ROOM_ONLY":         3,
 	"CRUSHED_STANDING_ROOM_ONLY": 4,
-	"FULL": 5,
-	"NOT_ACCEPTING_PASSENGERS": 6,
+	"FULL":                       5,
+	"NOT_ACCEPTING_PASSENGERS":   6,
 }
 
 func (x VehiclePosition_OccupancyStatus) Enum() *VehiclePosition_OccupancyStatus {
@@ -447,10 +452,10 @@ func (x *TripDescriptor_ScheduleRelationship) UnmarshalJSON(data []byte) error {
 // All the entity ids are resolved with respect to the GTFS feed.
 //
 // A feed depends on some external configuration:
-// - The corresponding GTFS feed.
-// - Feed application (updates, positions or alerts). A feed should contain only
-//   items of one specified application; all the other entities will be ignored.
-// - Polling frequency
+//   - The corresponding GTFS feed.
+//   - Feed application (updates, positions or alerts). A feed should contain only
+//     items of one specified application; all the other entities will be ignored.
+//   - Polling frequency
 type FeedMessage struct {
 	// Metadata about this feed and feed message.
 	Header *FeedHeader `protobuf:"bytes,1,req,name=header" json:"header,omitempty"`
@@ -705,12 +710,12 @@ func (m *TripUpdate) GetTimestamp() uint64 {
 // Timing information for a single predicted event (either arrival or
 // departure).
 // Timing consists of delay and/or estimated time, and uncertainty.
-// - delay should be used when the prediction is given relative to some
-//   existing schedule in GTFS.
-// - time should be given whether there is a predicted schedule or not. If
-//   both time and delay are specified, time will take precedence
-//   (although normally, time, if given for a scheduled trip, should be
-//   equal to scheduled time in GTFS + delay).
+//   - delay should be used when the prediction is given relative to some
+//     existing schedule in GTFS.
+//   - time should be given whether there is a predicted schedule or not. If
+//     both time and delay are specified, time will take precedence
+//     (although normally, time, if given for a scheduled trip, should be
+//     equal to scheduled time in GTFS + delay).
 //
 // Uncertainty applies equally to both time and delay.
 // The uncertainty roughly specifies the expected error in true delay (but
@@ -1155,13 +1160,13 @@ func (m *Position) GetSpeed() float32 {
 
 // A descriptor that identifies an instance of a GTFS trip, or all instances of
 // a trip along a route.
-// - To specify a single trip instance, the trip_id (and if necessary,
-//   start_time) is set. If route_id is also set, then it should be same as one
-//   that the given trip corresponds to.
-// - To specify all the trips along a given route, only the route_id should be
-//   set. Note that if the trip_id is not known, then stop sequence ids in
-//   TripUpdate are not sufficient, and stop_ids must be provided as well. In
-//   addition, absolute arrival/departure times must be provided.
+//   - To specify a single trip instance, the trip_id (and if necessary,
+//     start_time) is set. If route_id is also set, then it should be same as one
+//     that the given trip corresponds to.
+//   - To specify all the trips along a given route, only the route_id should be
+//     set. Note that if the trip_id is not known, then stop sequence ids in
+//     TripUpdate are not sufficient, and stop_ids must be provided as well. In
+//     addition, absolute arrival/departure times must be provided.
 type TripDescriptor struct {
 	// The trip_id from the GTFS feed that this selector refers to.
 	// For non frequency expanded trips, this field is enough to uniquely identify
@@ -1373,12 +1378,12 @@ func (m *EntitySelector) GetStopId() string {
 // text or a URL.
 // One of the strings from a message will be picked up. The resolution proceeds
 // as follows:
-// 1. If the UI language matches the language code of a translation,
-//    the first matching translation is picked.
-// 2. If a default UI language (e.g., English) matches the language code of a
-//    translation, the first matching translation is picked.
-// 3. If some translation has an unspecified language code, that translation is
-//    picked.
+//  1. If the UI language matches the language code of a translation,
+//     the first matching translation is picked.
+//  2. If a default UI language (e.g., English) matches the language code of a
+//     translation, the first matching translation is picked.
+//  3. If some translation has an unspecified language code, that translation is
+//     picked.
 type TranslatedString struct {
 	// At least one translation must be provided.
 	Translation      []*TranslatedString_Translation `protobuf:"bytes,1,rep,name=translation" json:"translation,omitempty"`
@@ -0,0 +1,128 @@
+// Code generated by protoc-gen-go.
+// source: stop_time_prediction.proto
+// DO NOT EDIT!
+
+package gtfsrt
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type StopTimePrediction struct {
+	TripId    *string `protobuf:"bytes,1,opt,name=trip_id" json:"trip_id,omitempty"`
+	RouteId   *string `protobuf:"bytes,2,opt,name=route_id" json:"route_id,omitempty"`
+	VehicleId *string `protobuf:"bytes,3,opt,name=vehicle_id" json:"vehicle_id,omitempty"`
+	// when the feed made the prediction, in seconds since the epoch
+	Timestamp            *int64  `protobuf:"varint,4,opt,name=timestamp" json:"timestamp,omitempty"`
+	StopSequence         *uint32 `protobuf:"varint,5,opt,name=stop_sequence" json:"stop_sequence,omitempty"`
+	StopId               *string `protobuf:"bytes,6,opt,name=stop_id" json:"stop_id,omitempty"`
+	ArrivalDelay         *int32  `protobuf:"varint,7,opt,name=arrival_delay" json:"arrival_delay,omitempty"`
+	ArrivalTime          *int64  `protobuf:"varint,8,opt,name=arrival_time" json:"arrival_time,omitempty"`
+	ArrivalUncertainty   *int32  `protobuf:"varint,9,opt,name=arrival_uncertainty" json:"arrival_uncertainty,omitempty"`
+	DepartureDelay       *int32  `protobuf:"varint,10,opt,name=departure_delay" json:"departure_delay,omitempty"`
+	DepartureTime        *int64  `protobuf:"varint,11,opt,name=departure_time" json:"departure_time,omitempty"`
+	DepartureUncertainty *int32  `protobuf:"varint,12,opt,name=departure_uncertainty" json:"departure_uncertainty,omitempty"`
+	ScheduleRelationship *string `protobuf:"bytes,13,opt,name=schedule_relationship" json:"schedule_relationship,omitempty"`
+	XXX_unrecognized     []byte  `json:"-"`
+}
+
+func (m *StopTimePrediction) Reset()         { *m = StopTimePrediction{} }
+func (m *StopTimePrediction) String() string { return proto.CompactTextString(m) }
+func (*StopTimePrediction) ProtoMessage()    {}
+
+func (m *StopTimePrediction) GetTripId() string {
+	if m != nil && m.TripId != nil {
+		return *m.TripId
+	}
+	return ""
+}
+
+func (m *StopTimePrediction) GetRouteId() string {
+	if m != nil && m.RouteId != nil {
+		return *m.RouteId
+	}
+	return ""
+}
+
+func (m *StopTimePrediction) GetVehicleId() string {
+	if m != nil && m.VehicleId != nil {
+		return *m.VehicleId
+	}
+	return ""
+}
+
+func (m *StopTimePrediction) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetStopSequence() uint32 {
+	if m != nil && m.StopSequence != nil {
+		return *m.StopSequence
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetStopId() string {
+	if m != nil && m.StopId != nil {
+		return *m.StopId
+	}
+	return ""
+}
+
+func (m *StopTimePrediction) GetArrivalDelay() int32 {
+	if m != nil && m.ArrivalDelay != nil {
+		return *m.ArrivalDelay
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetArrivalTime() int64 {
+	if m != nil && m.ArrivalTime != nil {
+		return *m.ArrivalTime
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetArrivalUncertainty() int32 {
+	if m != nil && m.ArrivalUncertainty != nil {
+		return *m.ArrivalUncertainty
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetDepartureDelay() int32 {
+	if m != nil && m.DepartureDelay != nil {
+		return *m.DepartureDelay
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetDepartureTime() int64 {
+	if m != nil && m.DepartureTime != nil {
+		return *m.DepartureTime
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetDepartureUncertainty() int32 {
+	if m != nil && m.DepartureUncertainty != nil {
+		return *m.DepartureUncertainty
+	}
+	return 0
+}
+
+func (m *StopTimePrediction) GetScheduleRelationship() string {
+	if m != nil && m.ScheduleRelationship != nil {
+		return *m.ScheduleRelationship
+	}
+	return ""
+}
+
+func init() {
+}
@@ -1,16 +1,7 @@
 // Code generated by protoc-gen-go.
-// source: vehiclelocation.proto
+// source: vehicle_location.proto
 // DO NOT EDIT!
 
-/*
-Package capmetricsd is a generated protocol buffer package.
-
-It is generated from these files:
-    vehiclelocation.proto
-
-It has these top-level messages:
-    VehicleLocation
-*/
 package gtfsrt
 
 import proto "github.com/golang/protobuf/proto"
@@ -21,15 +12,25 @@ var _ = proto.Marshal
 var _ = math.Inf
 
 type VehicleLocation struct {
-	VehicleId        *string  `protobuf:"bytes,1,opt,name=vehicle_id" json:"vehicle_id,omitempty"`
-	Timestamp        *int64   `protobuf:"varint,2,opt,name=timestamp" json:"timestamp,omitempty"`
-	Speed            *float32 `protobuf:"fixed32,3,opt,name=speed" json:"speed,omitempty"`
-	RouteId          *string  `protobuf:"bytes,4,opt,name=route_id" json:"route_id,omitempty"`
-	TripId           *string  `protobuf:"bytes,5,opt,name=trip_id" json:"trip_id,omitempty"`
-	Bearing          *float32 `protobuf:"fixed32,6,opt,name=bearing" json:"bearing,omitempty"`
-	Latitude         *float32 `protobuf:"fixed32,7,opt,name=latitude" json:"latitude,omitempty"`
-	Longitude        *float32 `protobuf:"fixed32,8,opt,name=longitude" json:"longitude,omitempty"`
-	XXX_unrecognized []byte   `json:"-"`
+	VehicleId *string `protobuf:"bytes,1,opt,name=vehicle_id" json:"vehicle_id,omitempty"`
+	// seconds since the epoch
+	Timestamp           *int64   `protobuf:"varint,2,opt,name=timestamp" json:"timestamp,omitempty"`
+	Speed               *float32 `protobuf:"fixed32,3,opt,name=speed" json:"speed,omitempty"`
+	RouteId             *string  `protobuf:"bytes,4,opt,name=route_id" json:"route_id,omitempty"`
+	TripId              *string  `protobuf:"bytes,5,opt,name=trip_id" json:"trip_id,omitempty"`
+	Bearing             *float32 `protobuf:"fixed32,6,opt,name=bearing" json:"bearing,omitempty"`
+	Latitude            *float32 `protobuf:"fixed32,7,opt,name=latitude" json:"latitude,omitempty"`
+	Longitude           *float32 `protobuf:"fixed32,8,opt,name=longitude" json:"longitude,omitempty"`
+	Odometer            *float64 `protobuf:"fixed64,9,opt,name=odometer" json:"odometer,omitempty"`
+	StopId              *string  `protobuf:"bytes,10,opt,name=stop_id" json:"stop_id,omitempty"`
+	CurrentStopSequence *uint32  `protobuf:"varint,11,opt,name=current_stop_sequence" json:"current_stop_sequence,omitempty"`
+	CurrentStatus       *string  `protobuf:"bytes,12,opt,name=current_status" json:"current_status,omitempty"`
+	CongestionLevel     *string  `protobuf:"bytes,13,opt,name=congestion_level" json:"congestion_level,omitempty"`
+	OccupancyStatus     *string  `protobuf:"bytes,14,opt,name=occupancy_status" json:"occupancy_status,omitempty"`
+	StartDate           *string  `protobuf:"bytes,15,opt,name=start_date" json:"start_date,omitempty"`
+	StartTime           *string  `protobuf:"bytes,16,opt,name=start_time" json:"start_time,omitempty"`
+	VehicleLabel        *string  `protobuf:"bytes,17,opt,name=vehicle_label" json:"vehicle_label,omitempty"`
+	XXX_unrecognized    []byte   `json:"-"`
 }
 
 func (m *VehicleLocation) Reset()         { *m = VehicleLocation{} }
@@ -91,3 +92,69 @@ func (m *VehicleLocation) GetLongitude() float32 {
 	}
 	return 0
 }
+
+func (m *VehicleLocation) GetOdometer() float64 {
+	if m != nil && m.Odometer != nil {
+		return *m.Odometer
+	}
+	return 0
+}
+
+func (m *VehicleLocation) GetStopId() string {
+	if m != nil && m.StopId != nil {
+		return *m.StopId
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetCurrentStopSequence() uint32 {
+	if m != nil && m.CurrentStopSequence != nil {
+		return *m.CurrentStopSequence
+	}
+	return 0
+}
+
+func (m *VehicleLocation) GetCurrentStatus() string {
+	if m != nil && m.CurrentStatus != nil {
+		return *m.CurrentStatus
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetCongestionLevel() string {
+	if m != nil && m.CongestionLevel != nil {
+		return *m.CongestionLevel
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetOccupancyStatus() string {
+	if m != nil && m.OccupancyStatus != nil {
+		return *m.OccupancyStatus
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetStartDate() string {
+	if m != nil && m.StartDate != nil {
+		return *m.StartDate
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetStartTime() string {
+	if m != nil && m.StartTime != nil {
+		return *m.StartTime
+	}
+	return ""
+}
+
+func (m *VehicleLocation) GetVehicleLabel() string {
+	if m != nil && m.VehicleLabel != nil {
+		return *m.VehicleLabel
+	}
+	return ""
+}
+
+func init() {
+}
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"time"
+)
+
+const (
+	// TIME_INDEX_INTERVAL is the period of time covered by each bucket of the
+	// time index.
+	TIME_INDEX_INTERVAL = time.Hour
+	// REINDEX_BATCH_SIZE is the number of trips indexed per transaction when
+	// backfilling indexes.
+	REINDEX_BATCH_SIZE = 100
+	// INDEX_FORMAT_VERSION identifies how index entries are keyed. Version 1
+	// keyed the vehicle index by location key alone, so a vehicle's locations
+	// on two trips at the same time overwrote each other. Version 2 appends
+	// the trip ID.
+	INDEX_FORMAT_VERSION = "2"
+
+	indexesCompleteKey = "indexes_complete"
+	indexFormatKey     = "index_format"
+)
+
+// TimeIndexKey returns the key of the time index bucket covering ts.
+func TimeIndexKey(ts int64) []byte {
+	interval := int64(TIME_INDEX_INTERVAL / time.Second)
+	return TimeKey(ts - ts%interval)
+}
+
+// CreateLocationsBucket returns the bucket holding trip buckets, creating it
+// if necessary. Indexes are written alongside every location, so a database
+// which has never held locations starts out fully indexed.
+func CreateLocationsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if b := tx.Bucket([]byte(BUCKET_NAME)); b != nil {
+		return b, nil
+	}
+
+	b, err := tx.CreateBucket([]byte(BUCKET_NAME))
+	if err != nil {
+		return nil, err
+	}
+	return b, markIndexesComplete(tx)
+}
+
+// IndexesComplete reports whether every location in the database is indexed
+// in the current format. Databases written before indexes were added, or
+// before their format last changed, aren't until they're backfilled with
+// Reindex.
+func IndexesComplete(tx *bolt.Tx) bool {
+	meta := tx.Bucket([]byte(META_BUCKET_NAME))
+	return meta != nil && meta.Get([]byte(indexesCompleteKey)) != nil && string(meta.Get([]byte(indexFormatKey))) == INDEX_FORMAT_VERSION
+}
+
+func markIndexesComplete(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET_NAME))
+	if err != nil {
+		return err
+	}
+	if err = meta.Put([]byte(indexFormatKey), []byte(INDEX_FORMAT_VERSION)); err != nil {
+		return err
+	}
+	return meta.Put([]byte(indexesCompleteKey), []byte(time.Now().Format(ISO8601_FORMAT)))
+}
+
+// VehicleIndexKey returns the key of a location in the vehicle index: its key
+// in the trip's bucket followed by the trip ID, so a vehicle serving two trips
+// at once has an entry for each.
+func VehicleIndexKey(key, tripID []byte) []byte {
+	return append(append([]byte{}, key...), tripID...)
+}
+
+func putIndexEntry(tx *bolt.Tx, index string, bucket, key, value []byte) error {
+	indexBucket, err := tx.CreateBucketIfNotExists([]byte(index))
+	if err != nil {
+		return err
+	}
+	b, err := indexBucket.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// IndexLocation adds a location stored under key in a trip's bucket to the
+// indexes:
+//
+//	index_time/<start of interval>/<trip_id>
+//	index_route/<route_id>/<trip_id>
+//	index_vehicle/<vehicle_id>/<location key><trip_id> -> <trip_id>
+func IndexLocation(tx *bolt.Tx, tripID, key []byte, location *gtfsrt.VehicleLocation) error {
+	if err := putIndexEntry(tx, TIME_INDEX_BUCKET_NAME, TimeIndexKey(location.GetTimestamp()), tripID, []byte{}); err != nil {
+		return err
+	}
+
+	if route := location.GetRouteId(); route != "" {
+		if err := putIndexEntry(tx, ROUTE_INDEX_BUCKET_NAME, []byte(route), tripID, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	if vehicle := location.GetVehicleId(); vehicle != "" {
+		if err := putIndexEntry(tx, VEHICLE_INDEX_BUCKET_NAME, []byte(vehicle), VehicleIndexKey(key, tripID), tripID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reindex backfills the indexes for every location in the database, a batch
+// of trips per transaction, and returns the number of locations indexed. A
+// vehicle index in an older format is rebuilt from scratch.
+func Reindex(db *bolt.DB) (count int, err error) {
+	var trips [][]byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(META_BUCKET_NAME))
+		if (meta == nil || string(meta.Get([]byte(indexFormatKey))) != INDEX_FORMAT_VERSION) && tx.Bucket([]byte(VEHICLE_INDEX_BUCKET_NAME)) != nil {
+			if err := tx.DeleteBucket([]byte(VEHICLE_INDEX_BUCKET_NAME)); err != nil {
+				return err
+			}
+		}
+
+		topBucket := tx.Bucket([]byte(BUCKET_NAME))
+		if topBucket == nil {
+			return nil
+		}
+		return topBucket.ForEach(func(tripID, _ []byte) error {
+			trips = append(trips, append([]byte{}, tripID...))
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	for start := 0; start < len(trips); start += REINDEX_BATCH_SIZE {
+		end := start + REINDEX_BATCH_SIZE
+		if end > len(trips) {
+			end = len(trips)
+		}
+
+		indexed := 0
+		err = db.Update(func(tx *bolt.Tx) error {
+			indexed = 0
+			topBucket := tx.Bucket([]byte(BUCKET_NAME))
+			for _, tripID := range trips[start:end] {
+				c := topBucket.Bucket(tripID).Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					var location gtfsrt.VehicleLocation
+					if err := proto.Unmarshal(v, &location); err != nil {
+						return err
+					}
+					// keys point into the mmap, which may be remapped as the
+					// indexes grow, so they're copied before being stored
+					key := append([]byte{}, k...)
+					if err := IndexLocation(tx, tripID, key, &location); err != nil {
+						return err
+					}
+					indexed++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		count += indexed
+		dlog.Printf("Indexed %d of %d trips\n", end, len(trips))
+	}
+
+	err = db.Update(markIndexesComplete)
+	return
+}
@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// storeLocation stores and indexes a location like the daemon does.
+func storeLocation(t *testing.T, tx *bolt.Tx, trip, vehicle, route string, ts int64) {
+	location := &gtfsrt.VehicleLocation{TripId: proto.String(trip), VehicleId: proto.String(vehicle), RouteId: proto.String(route), Timestamp: proto.Int64(ts)}
+	if err := storeSingleLocation([]byte(trip), location, tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vehicleEntries returns the trips of each entry of a vehicle in the vehicle
+// index, keyed by location key.
+func vehicleEntries(tx *bolt.Tx, vehicle string) map[string][]string {
+	entries := map[string][]string{}
+	b := tx.Bucket([]byte(VEHICLE_INDEX_BUCKET_NAME))
+	if b != nil {
+		b = b.Bucket([]byte(vehicle))
+	}
+	if b == nil {
+		return entries
+	}
+	b.ForEach(func(k, trip []byte) error {
+		key := string(k[:len(k)-len(trip)])
+		entries[key] = append(entries[key], string(trip))
+		return nil
+	})
+	return entries
+}
+
+func TestVehicleIndexInterlined(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	// v1 reports on tripA and tripB at the same times as it's interlined
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, ts := range []int64{1449813600, 1449813630, 1449813660} {
+			storeLocation(t, tx, "tripA", "v1", "801", ts)
+			storeLocation(t, tx, "tripB", "v1", "803", ts)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		entries := vehicleEntries(tx, "v1")
+		if len(entries) != 3 {
+			t.Fatalf("got %d locations in the vehicle index, want 3", len(entries))
+		}
+		for key, trips := range entries {
+			if len(trips) != 2 || trips[0] != "tripA" || trips[1] != "tripB" {
+				t.Errorf("location %x: got trips %v, want tripA and tripB", key, trips)
+			}
+		}
+		return nil
+	})
+
+	// pruning one of the trips leaves the other's entries alone
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, emptied, err := pruneTrip(tx, []byte("tripA"), 1449813700)
+		if !emptied {
+			t.Error("tripA wasn't emptied")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		entries := vehicleEntries(tx, "v1")
+		if len(entries) != 3 {
+			t.Errorf("got %d locations in the vehicle index after pruning tripA, want 3", len(entries))
+		}
+		for key, trips := range entries {
+			if len(trips) != 1 || trips[0] != "tripB" {
+				t.Errorf("location %x: got trips %v after pruning tripA, want tripB", key, trips)
+			}
+		}
+		return nil
+	})
+}
+
+func TestReindexOldVehicleIndex(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	// a database indexed before vehicle index keys held the trip ID
+	key := LocationKey(1449813600, "v1")
+	err := db.Update(func(tx *bolt.Tx) error {
+		storeLocation(t, tx, "tripA", "v1", "801", 1449813600)
+		storeLocation(t, tx, "tripB", "v1", "803", 1449813600)
+		if err := tx.DeleteBucket([]byte(VEHICLE_INDEX_BUCKET_NAME)); err != nil {
+			return err
+		}
+		put(t, tx, []byte("tripB"), VEHICLE_INDEX_BUCKET_NAME, "v1", string(key))
+		return tx.Bucket([]byte(META_BUCKET_NAME)).Delete([]byte(indexFormatKey))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if IndexesComplete(tx) {
+			t.Error("indexes in the old format are complete")
+		}
+		return nil
+	})
+
+	count, err := Reindex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("indexed %d locations, want 2", count)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if !IndexesComplete(tx) {
+			t.Error("indexes aren't complete after reindexing")
+		}
+		got := keys(tx, VEHICLE_INDEX_BUCKET_NAME, "v1")
+		want := [][]byte{VehicleIndexKey(key, []byte("tripA")), VehicleIndexKey(key, []byte("tripB"))}
+		if len(got) != len(want) || !bytes.Equal(got[0], want[0]) || !bytes.Equal(got[1], want[1]) {
+			t.Errorf("got vehicle index keys %q, want %q", got, want)
+		}
+		return nil
+	})
+}
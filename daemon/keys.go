@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strconv"
+)
+
+const (
+	// KEY_FORMAT_VERSION identifies how keys are encoded. Version 1 keys were
+	// POSIX times formatted as decimal strings, which don't sort by time once
+	// timestamps differ in length. Version 2 keys are big-endian uint64s.
+	// Version 3 names the stop buckets of trip updates by a prefixed stop
+	// sequence or stop ID rather than either as is.
+	KEY_FORMAT_VERSION = "3"
+
+	// stopKeyFormatVersion is the last version which only differs from the
+	// current one by its stop keys.
+	stopKeyFormatVersion = "2"
+
+	// TIME_KEY_SIZE is the length of the time at the start of keys.
+	TIME_KEY_SIZE = 8
+
+	keyFormatKey = "key_format"
+)
+
+var ErrLegacyKeys = errors.New("database was written by an older version of capmetricsd, run capmetricsd migrate on it first")
+
+// TimeKey encodes a POSIX time as a big-endian uint64 so keys sort by time.
+// Times before the epoch are clamped to it.
+func TimeKey(ts int64) []byte {
+	if ts < 0 {
+		ts = 0
+	}
+	key := make([]byte, TIME_KEY_SIZE)
+	binary.BigEndian.PutUint64(key, uint64(ts))
+	return key
+}
+
+// KeyTime decodes the POSIX time at the start of a key.
+func KeyTime(key []byte) int64 {
+	if len(key) < TIME_KEY_SIZE {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(key[:TIME_KEY_SIZE]))
+}
+
+// LocationKey returns the key a location is stored under within its trip
+// bucket: its POSIX time followed by the vehicle ID, so that several vehicles
+// reporting for the same trip at the same time don't overwrite each other.
+func LocationKey(ts int64, vehicleID string) []byte {
+	return append(TimeKey(ts), vehicleID...)
+}
+
+// SplitLocationKey returns the POSIX time and vehicle ID of a location key.
+func SplitLocationKey(key []byte) (ts int64, vehicleID string) {
+	if len(key) < TIME_KEY_SIZE {
+		return 0, ""
+	}
+	return KeyTime(key), string(key[TIME_KEY_SIZE:])
+}
+
+// CheckKeyFormat returns ErrLegacyKeys if the database holds keys in an older
+// format.
+func CheckKeyFormat(tx *bolt.Tx) error {
+	if meta := tx.Bucket([]byte(META_BUCKET_NAME)); meta != nil {
+		if format := meta.Get([]byte(keyFormatKey)); format != nil {
+			if string(format) == stopKeyFormatVersion {
+				return ErrLegacyKeys
+			}
+			if string(format) != KEY_FORMAT_VERSION {
+				return fmt.Errorf("unsupported key format: %s", format)
+			}
+			return nil
+		}
+	}
+
+	if tx.Bucket([]byte(BUCKET_NAME)) != nil || tx.Bucket([]byte(TRIP_UPDATES_BUCKET_NAME)) != nil {
+		return ErrLegacyKeys
+	}
+	return nil
+}
+
+func markKeyFormat(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET_NAME))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(keyFormatKey), []byte(KEY_FORMAT_VERSION))
+}
+
+// PrepareDB checks the database can be written to by this version of
+// capmetricsd, recording the key format of new databases.
+func PrepareDB(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := CheckKeyFormat(tx); err != nil {
+			return err
+		}
+		return markKeyFormat(tx)
+	})
+}
+
+// keyFormat returns the key format recorded in the database, or "" if there
+// isn't one.
+func keyFormat(tx *bolt.Tx) string {
+	if meta := tx.Bucket([]byte(META_BUCKET_NAME)); meta != nil {
+		return string(meta.Get([]byte(keyFormatKey)))
+	}
+	return ""
+}
+
+// isStopKey reports whether a stop bucket is named in the current format.
+func isStopKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(STOP_SEQUENCE_PREFIX)) || bytes.HasPrefix(key, []byte(STOP_ID_PREFIX))
+}
+
+// isLegacyKey reports whether a key holds a version 1 decimal timestamp. Those
+// always start with a digit, while version 2 keys start with a zero byte for
+// any time before the year 292277026596.
+func isLegacyKey(key []byte) bool {
+	return len(key) > 0 && key[0] >= '0' && key[0] <= '9'
+}
+
+// legacyKeyTime parses the POSIX time of a version 1 key, which may be
+// followed by ':' and a vehicle ID.
+func legacyKeyTime(key []byte) (ts int64, rest []byte, err error) {
+	digits := key
+	if i := bytes.IndexByte(key, ':'); i >= 0 {
+		digits, rest = key[:i], key[i+1:]
+	}
+	ts, err = strconv.ParseInt(string(digits), 10, 64)
+	return
+}
@@ -0,0 +1,443 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FETCH_DURATION_BUCKETS are the upper bounds, in seconds, of the buckets of
+// the fetch latency histogram.
+var FETCH_DURATION_BUCKETS = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// The reasons a feed is skipped, as labelled in metrics.
+const (
+	SKIP_NOT_MODIFIED = "not_modified"
+	SKIP_STALE        = "stale"
+)
+
+// histogram counts observations in cumulative buckets, as Prometheus expects.
+type histogram struct {
+	counts []int
+	count  int
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int, len(FETCH_DURATION_BUCKETS))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range FETCH_DURATION_BUCKETS {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// feedMetrics holds the metrics of a single feed. Its methods are safe to call
+// on a nil *feedMetrics, which records nothing.
+type feedMetrics struct {
+	mu     sync.Mutex
+	name   string
+	dbPath string
+
+	// keyed by the kind of feed, e.g. RAW_VEHICLE_POSITIONS
+	fetchDurations map[string]*histogram
+	responses      map[string]map[string]int
+	skipped        map[string]map[string]int
+	decodeErrors   map[string]int
+	headerTimes    map[string]int64
+
+	locationsSeen   int
+	locationsValid  int
+	locationsStored int
+	tripsActive     int
+
+	// keyed by captureOutcome.String()
+	captures map[string]int
+	interval time.Duration
+}
+
+func newFeedMetrics(config FeedConfig) *feedMetrics {
+	m := &feedMetrics{
+		name:           config.Name,
+		dbPath:         config.DBPath,
+		fetchDurations: map[string]*histogram{},
+		responses:      map[string]map[string]int{},
+		skipped:        map[string]map[string]int{},
+		decodeErrors:   map[string]int{},
+		headerTimes:    map[string]int64{},
+		captures:       map[string]int{},
+		interval:       config.Interval.Duration,
+	}
+
+	// start the counters of each kind of feed captured at zero, so rates can
+	// be computed from the first scrape
+	for kind, url := range map[string]string{
+		RAW_VEHICLE_POSITIONS: config.VehiclePositionsURL,
+		RAW_TRIP_UPDATES:      config.TripUpdatesURL,
+		RAW_ALERTS:            config.AlertsURL,
+	} {
+		if url == "" {
+			continue
+		}
+		m.fetchDurations[kind] = newHistogram()
+		m.responses[kind] = map[string]int{}
+		m.skipped[kind] = map[string]int{SKIP_NOT_MODIFIED: 0, SKIP_STALE: 0}
+		m.decodeErrors[kind] = 0
+	}
+	return m
+}
+
+// fetched records a single request for a kind of feed. code is the HTTP
+// status of the response, or "error" if there wasn't one.
+func (m *feedMetrics) fetched(kind, code string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fetchDurations[kind] == nil {
+		m.fetchDurations[kind] = newHistogram()
+	}
+	m.fetchDurations[kind].observe(elapsed.Seconds())
+	if m.responses[kind] == nil {
+		m.responses[kind] = map[string]int{}
+	}
+	m.responses[kind][code]++
+}
+
+// skip records a kind of feed being skipped for reason, returning how many
+// times it's been skipped for each reason so far.
+func (m *feedMetrics) skip(kind, reason string) (notModified, stale int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.skipped[kind] == nil {
+		m.skipped[kind] = map[string]int{}
+	}
+	m.skipped[kind][reason]++
+	return m.skipped[kind][SKIP_NOT_MODIFIED], m.skipped[kind][SKIP_STALE]
+}
+
+func (m *feedMetrics) decodeError(kind string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decodeErrors[kind]++
+}
+
+func (m *feedMetrics) locations(stats LocationStats) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.locationsSeen += stats.Seen
+	m.locationsValid += stats.Valid
+	m.locationsStored += stats.Stored
+	m.tripsActive = stats.Trips
+}
+
+// headerTime records the header timestamp of the last feed of a kind captured,
+// which feed staleness is measured from.
+func (m *feedMetrics) headerTime(kind string, ts int64) {
+	if m == nil || ts <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.headerTimes[kind] = ts
+}
+
+// captured records the outcome of a capture and the interval until the next.
+func (m *feedMetrics) captured(outcome captureOutcome, interval time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.captures[outcome.String()]++
+	m.interval = interval
+}
+
+var (
+	metricsMu sync.RWMutex
+	metrics   = map[string]*feedMetrics{}
+)
+
+func registerMetrics(m *feedMetrics) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics[m.name] = m
+}
+
+func unregisterMetrics(name string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	delete(metrics, name)
+}
+
+// label is a name and value identifying one of a metric's time series.
+type label struct {
+	name  string
+	value string
+}
+
+// sample is a single value of a metric. suffix is appended to the metric's
+// name, e.g. "_bucket" for histograms.
+type sample struct {
+	suffix string
+	labels []label
+	value  float64
+}
+
+// metricFamily is a metric exported for every feed.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples func(m *feedMetrics, now time.Time) []sample
+}
+
+var metricFamilies = []metricFamily{
+	{
+		name: "capmetricsd_fetch_duration_seconds",
+		help: "Time taken by each request for a feed, including reading the response.",
+		typ:  "histogram",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.fetchDurations) {
+				h := m.fetchDurations[kind]
+				for i, bound := range FETCH_DURATION_BUCKETS {
+					le := strconv.FormatFloat(bound, 'g', -1, 64)
+					samples = append(samples, sample{"_bucket", m.labels("kind", kind, "le", le), float64(h.counts[i])})
+				}
+				samples = append(samples,
+					sample{"_bucket", m.labels("kind", kind, "le", "+Inf"), float64(h.count)},
+					sample{"_sum", m.labels("kind", kind), h.sum},
+					sample{"_count", m.labels("kind", kind), float64(h.count)},
+				)
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_fetch_responses_total",
+		help: "Requests for a feed by HTTP status, or \"error\" if no response was received.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.responses) {
+				for _, code := range sortedKeys(m.responses[kind]) {
+					samples = append(samples, sample{"", m.labels("kind", kind, "code", code), float64(m.responses[kind][code])})
+				}
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_feeds_skipped_total",
+		help: "Feeds which weren't captured because they hadn't changed since the last capture.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.skipped) {
+				for _, reason := range sortedKeys(m.skipped[kind]) {
+					samples = append(samples, sample{"", m.labels("kind", kind, "reason", reason), float64(m.skipped[kind][reason])})
+				}
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_decode_errors_total",
+		help: "Feeds which couldn't be decoded as GTFS-realtime.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.decodeErrors) {
+				samples = append(samples, sample{"", m.labels("kind", kind), float64(m.decodeErrors[kind])})
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_locations_seen_total",
+		help: "Vehicle positions in the Vehicle Positions feeds captured.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			return []sample{{"", m.labels(), float64(m.locationsSeen)}}
+		},
+	},
+	{
+		name: "capmetricsd_locations_valid_total",
+		help: "Vehicle positions with a route, trip and vehicle, which are kept.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			return []sample{{"", m.labels(), float64(m.locationsValid)}}
+		},
+	},
+	{
+		name: "capmetricsd_locations_stored_total",
+		help: "Locations stored, excluding duplicates and those written to the dead letter file.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			return []sample{{"", m.labels(), float64(m.locationsStored)}}
+		},
+	},
+	{
+		name: "capmetricsd_trips_active",
+		help: "Trips with valid locations in the last Vehicle Positions feed captured.",
+		typ:  "gauge",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			return []sample{{"", m.labels(), float64(m.tripsActive)}}
+		},
+	},
+	{
+		name: "capmetricsd_feed_timestamp_seconds",
+		help: "Header timestamp of the last feed captured.",
+		typ:  "gauge",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.headerTimes) {
+				samples = append(samples, sample{"", m.labels("kind", kind), float64(m.headerTimes[kind])})
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_feed_staleness_seconds",
+		help: "Time since the header timestamp of the last feed captured.",
+		typ:  "gauge",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, kind := range sortedKeys(m.headerTimes) {
+				staleness := now.Sub(time.Unix(m.headerTimes[kind], 0)).Seconds()
+				samples = append(samples, sample{"", m.labels("kind", kind), staleness})
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_captures_total",
+		help: "Captures by outcome: updated, empty, unchanged or failed.",
+		typ:  "counter",
+		samples: func(m *feedMetrics, now time.Time) (samples []sample) {
+			for _, outcome := range sortedKeys(m.captures) {
+				samples = append(samples, sample{"", m.labels("outcome", outcome), float64(m.captures[outcome])})
+			}
+			return
+		},
+	},
+	{
+		name: "capmetricsd_capture_interval_seconds",
+		help: "Interval until the next capture, which varies on an adaptive schedule.",
+		typ:  "gauge",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			return []sample{{"", m.labels(), m.interval.Seconds()}}
+		},
+	},
+	{
+		name: "capmetricsd_db_size_bytes",
+		help: "Size of the feed's database file.",
+		typ:  "gauge",
+		samples: func(m *feedMetrics, now time.Time) []sample {
+			info, err := os.Stat(m.dbPath)
+			if err != nil {
+				return nil
+			}
+			return []sample{{"", m.labels(), float64(info.Size())}}
+		},
+	},
+}
+
+// labels returns the feed's name label followed by the given name and value
+// pairs.
+func (m *feedMetrics) labels(pairs ...string) []label {
+	labels := []label{{"feed", m.name}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, label{pairs[i], pairs[i+1]})
+	}
+	return labels
+}
+
+// sortedKeys returns the keys of a map with string keys in order, so metrics
+// are always written in the same order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]int64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsByName []*feedMetrics
+
+func (b metricsByName) Len() int           { return len(b) }
+func (b metricsByName) Less(i, j int) bool { return b[i].name < b[j].name }
+func (b metricsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// WriteMetrics writes the metrics of every feed being captured in the
+// Prometheus text exposition format.
+func WriteMetrics(w io.Writer) error {
+	metricsMu.RLock()
+	var feeds []*feedMetrics
+	for _, m := range metrics {
+		feeds = append(feeds, m)
+	}
+	metricsMu.RUnlock()
+	sort.Sort(metricsByName(feeds))
+
+	now := time.Now()
+	bw := bufio.NewWriter(w)
+	for _, family := range metricFamilies {
+		fmt.Fprintf(bw, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", family.name, family.typ)
+		for _, m := range feeds {
+			m.mu.Lock()
+			samples := family.samples(m, now)
+			m.mu.Unlock()
+
+			for _, s := range samples {
+				bw.WriteString(family.name + s.suffix + "{")
+				for i, l := range s.labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", l.name, labelEscaper.Replace(l.value))
+				}
+				fmt.Fprintf(bw, "} %s\n", strconv.FormatFloat(s.value, 'f', -1, 64))
+			}
+		}
+	}
+	return bw.Flush()
+}
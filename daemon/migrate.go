@@ -0,0 +1,213 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// Migrate rewrites a database written with decimal timestamp keys to use
+// fixed-width binary keys, and renames the stop buckets of trip updates to
+// the current format, then rebuilds its indexes if their keys changed. It
+// returns the number of keys rewritten. Migrating a database twice, or one
+// which was interrupted part way, is safe since keys already in the new
+// format are left alone.
+func Migrate(db *bolt.DB) (count int, err error) {
+	legacy, timeKeys := false, false
+	err = db.View(func(tx *bolt.Tx) error {
+		err := CheckKeyFormat(tx)
+		if err == ErrLegacyKeys {
+			legacy = true
+			timeKeys = keyFormat(tx) != stopKeyFormatVersion
+			return nil
+		}
+		return err
+	})
+	if err != nil || !legacy {
+		return
+	}
+
+	if timeKeys {
+		// vehicle_locations/<trip_id>/<key>
+		n, err := migrateTrips(db, BUCKET_NAME, func(tripBucket *bolt.Bucket) (int, error) {
+			return migrateKeys(tripBucket)
+		})
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	// trip_updates/<trip_id>/<stop>/<key>
+	n, err := migrateTrips(db, TRIP_UPDATES_BUCKET_NAME, migrateStops)
+	count += n
+	if err != nil {
+		return
+	}
+
+	// the indexes are keyed by time too, so they're rebuilt from scratch
+	err = db.Update(func(tx *bolt.Tx) error {
+		if !timeKeys {
+			return markKeyFormat(tx)
+		}
+		for _, index := range []string{TIME_INDEX_BUCKET_NAME, ROUTE_INDEX_BUCKET_NAME, VEHICLE_INDEX_BUCKET_NAME} {
+			if err := tx.DeleteBucket([]byte(index)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if meta := tx.Bucket([]byte(META_BUCKET_NAME)); meta != nil {
+			if err := meta.Delete([]byte(indexesCompleteKey)); err != nil {
+				return err
+			}
+		}
+		return markKeyFormat(tx)
+	})
+	if err != nil || !timeKeys {
+		return
+	}
+
+	_, err = Reindex(db)
+	return
+}
+
+// migrateTrips applies fn to each trip bucket of a top level bucket, a batch
+// of trips per transaction.
+func migrateTrips(db *bolt.DB, name string, fn func(tripBucket *bolt.Bucket) (int, error)) (count int, err error) {
+	var trips [][]byte
+	err = db.View(func(tx *bolt.Tx) error {
+		topBucket := tx.Bucket([]byte(name))
+		if topBucket == nil {
+			return nil
+		}
+		return topBucket.ForEach(func(tripID, _ []byte) error {
+			trips = append(trips, append([]byte{}, tripID...))
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	for start := 0; start < len(trips); start += REINDEX_BATCH_SIZE {
+		end := start + REINDEX_BATCH_SIZE
+		if end > len(trips) {
+			end = len(trips)
+		}
+
+		migrated := 0
+		err = db.Update(func(tx *bolt.Tx) error {
+			migrated = 0
+			topBucket := tx.Bucket([]byte(name))
+			for _, tripID := range trips[start:end] {
+				tripBucket := topBucket.Bucket(tripID)
+				if tripBucket == nil {
+					continue
+				}
+				n, err := fn(tripBucket)
+				migrated += n
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		count += migrated
+		dlog.Printf("Migrated %d of %d trips in %s\n", end, len(trips), name)
+	}
+	return
+}
+
+// migrateKeys rewrites the decimal timestamp keys of a bucket as binary keys.
+func migrateKeys(b *bolt.Bucket) (count int, err error) {
+	type entry struct {
+		key, value []byte
+	}
+
+	// keys and values point into the mmap, which may be remapped by the
+	// writes, so they're copied first
+	var legacy []entry
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil && isLegacyKey(k) {
+			legacy = append(legacy, entry{append([]byte{}, k...), append([]byte{}, v...)})
+		}
+	}
+
+	for _, e := range legacy {
+		ts, rest, err := legacyKeyTime(e.key)
+		if err != nil {
+			return count, fmt.Errorf("Unreadable key %q: %s", e.key, err)
+		}
+		if err = b.Delete(e.key); err != nil {
+			return count, err
+		}
+		if err = b.Put(append(TimeKey(ts), rest...), e.value); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return
+}
+
+// migrateStops moves the predictions of a trip out of stop buckets named by a
+// bare stop sequence or stop ID, rewriting any decimal timestamp keys. Each
+// prediction is moved to the bucket named by its own stop sequence or stop ID,
+// since the old names can't tell a stop sequence from a numeric stop ID.
+func migrateStops(tripBucket *bolt.Bucket) (count int, err error) {
+	var stops [][]byte
+	tripBucket.ForEach(func(stop, v []byte) error {
+		if v == nil && !isStopKey(stop) {
+			stops = append(stops, append([]byte{}, stop...))
+		}
+		return nil
+	})
+
+	for _, stop := range stops {
+		type entry struct {
+			key, value []byte
+		}
+		var predictions []entry
+		tripBucket.Bucket(stop).ForEach(func(k, v []byte) error {
+			if v != nil {
+				predictions = append(predictions, entry{append([]byte{}, k...), append([]byte{}, v...)})
+			}
+			return nil
+		})
+		if err = tripBucket.DeleteBucket(stop); err != nil {
+			return
+		}
+
+		for _, e := range predictions {
+			key := e.key
+			if isLegacyKey(key) {
+				ts, _, err := legacyKeyTime(key)
+				if err != nil {
+					return count, fmt.Errorf("Unreadable key %q: %s", key, err)
+				}
+				key = TimeKey(ts)
+			}
+
+			var prediction gtfsrt.StopTimePrediction
+			if err = proto.Unmarshal(e.value, &prediction); err != nil {
+				return
+			}
+			name := stopKey(&prediction)
+			if name == nil {
+				return count, fmt.Errorf("Prediction in stop bucket %q has no stop", stop)
+			}
+			stopBucket, err := tripBucket.CreateBucketIfNotExists(name)
+			if err != nil {
+				return count, err
+			}
+			if err = stopBucket.Put(key, e.value); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return
+}
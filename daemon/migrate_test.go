@@ -0,0 +1,281 @@
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// tempDB opens a new database in a temporary directory, which is removed by
+// the returned func.
+func tempDB(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "capmetricsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.boltdb"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// put stores a value at a path of buckets ending in a key, creating the
+// buckets as needed.
+func put(t *testing.T, tx *bolt.Tx, value []byte, path ...string) {
+	b, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range path[1 : len(path)-1] {
+		if b, err = b.CreateBucketIfNotExists([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.Put([]byte(path[len(path)-1]), value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func marshal(t *testing.T, pb proto.Message) []byte {
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// keys returns the keys of the bucket at a path, in order.
+func keys(tx *bolt.Tx, path ...string) (keys [][]byte) {
+	b := tx.Bucket([]byte(path[0]))
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+	if b == nil {
+		return nil
+	}
+	b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	// a database written by an older version, whose decimal keys don't sort
+	// by time: 999999999 sorts after 1449813600
+	locations := map[string]*gtfsrt.VehicleLocation{
+		"1449813600:5001": {VehicleId: proto.String("5001"), Timestamp: proto.Int64(1449813600), TripId: proto.String("trip1"), RouteId: proto.String("801")},
+		"1449813630:5002": {VehicleId: proto.String("5002"), Timestamp: proto.Int64(1449813630), TripId: proto.String("trip1"), RouteId: proto.String("801")},
+		"999999999:5001":  {VehicleId: proto.String("5001"), Timestamp: proto.Int64(999999999), TripId: proto.String("trip1"), RouteId: proto.String("801")},
+	}
+	prediction := &gtfsrt.StopTimePrediction{TripId: proto.String("trip1"), StopId: proto.String("stop1"), Timestamp: proto.Int64(1449813600)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for key, location := range locations {
+			put(t, tx, marshal(t, location), BUCKET_NAME, "trip1", key)
+		}
+		put(t, tx, marshal(t, prediction), TRIP_UPDATES_BUCKET_NAME, "trip1", "stop1", "1449813600")
+		// an index written with the old keys has to be thrown away
+		put(t, tx, []byte{}, TIME_INDEX_BUCKET_NAME, "1449813600", "trip1")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return CheckKeyFormat(tx)
+	})
+	if err != ErrLegacyKeys {
+		t.Fatalf("got %v for a legacy database, want ErrLegacyKeys", err)
+	}
+
+	count, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("migrated %d keys, want 4", count)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if err := CheckKeyFormat(tx); err != nil {
+			t.Errorf("key format after migrating: %s", err)
+		}
+		if !IndexesComplete(tx) {
+			t.Error("indexes aren't complete after migrating")
+		}
+
+		want := [][]byte{LocationKey(999999999, "5001"), LocationKey(1449813600, "5001"), LocationKey(1449813630, "5002")}
+		got := keys(tx, BUCKET_NAME, "trip1")
+		if len(got) != len(want) {
+			t.Fatalf("got %d location keys, want %d", len(got), len(want))
+		}
+		tripBucket := tx.Bucket([]byte(BUCKET_NAME)).Bucket([]byte("trip1"))
+		for i, key := range want {
+			if !bytes.Equal(got[i], key) {
+				t.Errorf("location key %d: got %x, want %x", i, got[i], key)
+			}
+			var location gtfsrt.VehicleLocation
+			if err := proto.Unmarshal(tripBucket.Get(key), &location); err != nil {
+				t.Fatal(err)
+			}
+			if ts, vehicle := SplitLocationKey(key); location.GetTimestamp() != ts || location.GetVehicleId() != vehicle {
+				t.Errorf("location %x holds the wrong location: %v", key, location)
+			}
+		}
+
+		if got := keys(tx, TRIP_UPDATES_BUCKET_NAME, "trip1", STOP_ID_PREFIX+"stop1"); len(got) != 1 || !bytes.Equal(got[0], TimeKey(1449813600)) {
+			t.Errorf("got prediction keys %x, want %x", got, TimeKey(1449813600))
+		}
+
+		wantHours := [][]byte{TimeIndexKey(999999999), TimeIndexKey(1449813600)}
+		if got := keys(tx, TIME_INDEX_BUCKET_NAME); len(got) != len(wantHours) || !bytes.Equal(got[0], wantHours[0]) || !bytes.Equal(got[1], wantHours[1]) {
+			t.Errorf("got time index buckets %x, want %x", got, wantHours)
+		}
+		if got := keys(tx, ROUTE_INDEX_BUCKET_NAME, "801"); len(got) != 1 || string(got[0]) != "trip1" {
+			t.Errorf("got route index %q, want trip1", got)
+		}
+		vehicleIndex := tx.Bucket([]byte(VEHICLE_INDEX_BUCKET_NAME)).Bucket([]byte("5001"))
+		for _, key := range [][]byte{LocationKey(999999999, "5001"), LocationKey(1449813600, "5001")} {
+			if trip := vehicleIndex.Get(VehicleIndexKey(key, []byte("trip1"))); string(trip) != "trip1" {
+				t.Errorf("vehicle index for %x: got %q, want trip1", key, trip)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrating again leaves the database alone
+	if count, err = Migrate(db); err != nil || count != 0 {
+		t.Errorf("migrating twice: got %d keys, %v", count, err)
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	// a migration which was interrupted after rewriting trip1 but before the
+	// key format was recorded
+	location := &gtfsrt.VehicleLocation{VehicleId: proto.String("5001"), Timestamp: proto.Int64(1449813600), TripId: proto.String("trip1")}
+	err := db.Update(func(tx *bolt.Tx) error {
+		put(t, tx, marshal(t, location), BUCKET_NAME, "trip1", string(LocationKey(1449813600, "5001")))
+		put(t, tx, marshal(t, location), BUCKET_NAME, "trip2", "1449813600:5001")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("migrated %d keys, want 1", count)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		for _, trip := range []string{"trip1", "trip2"} {
+			if got := keys(tx, BUCKET_NAME, trip); len(got) != 1 || !bytes.Equal(got[0], LocationKey(1449813600, "5001")) {
+				t.Errorf("%s: got keys %x", trip, got)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMigrateStopKeys(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	// a version 2 database, where stop sequence 5 and stop ID "5" share a
+	// bucket and stop sequence 10 sorts before 9
+	predictions := map[string][]*gtfsrt.StopTimePrediction{
+		"5": {
+			{TripId: proto.String("trip1"), StopSequence: proto.Uint32(5), StopId: proto.String("stopA"), Timestamp: proto.Int64(1449813600)},
+			{TripId: proto.String("trip1"), StopId: proto.String("5"), Timestamp: proto.Int64(1449813630)},
+		},
+		"9":  {{TripId: proto.String("trip1"), StopSequence: proto.Uint32(9), Timestamp: proto.Int64(1449813600)}},
+		"10": {{TripId: proto.String("trip1"), StopSequence: proto.Uint32(10), Timestamp: proto.Int64(1449813600)}},
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for stop, stopPredictions := range predictions {
+			for _, prediction := range stopPredictions {
+				put(t, tx, marshal(t, prediction), TRIP_UPDATES_BUCKET_NAME, "trip1", stop, string(TimeKey(prediction.GetTimestamp())))
+			}
+		}
+		storeLocation(t, tx, "trip1", "5001", "801", 1449813600)
+		if err := markIndexesComplete(tx); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(META_BUCKET_NAME)).Put([]byte(keyFormatKey), []byte("2"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return CheckKeyFormat(tx)
+	})
+	if err != ErrLegacyKeys {
+		t.Fatalf("got %v for a version 2 database, want ErrLegacyKeys", err)
+	}
+
+	count, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("migrated %d keys, want 4", count)
+	}
+
+	sequence := func(n uint32) string {
+		return string(stopKey(&gtfsrt.StopTimePrediction{StopSequence: proto.Uint32(n)}))
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if err := CheckKeyFormat(tx); err != nil {
+			t.Errorf("key format after migrating: %s", err)
+		}
+		if !IndexesComplete(tx) {
+			t.Error("indexes were thrown away though their keys didn't change")
+		}
+
+		want := []string{STOP_ID_PREFIX + "5", sequence(5), sequence(9), sequence(10)}
+		got := keys(tx, TRIP_UPDATES_BUCKET_NAME, "trip1")
+		if len(got) != len(want) {
+			t.Fatalf("got stop buckets %q, want %q", got, want)
+		}
+		for i := range want {
+			if string(got[i]) != want[i] {
+				t.Errorf("stop bucket %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+		if got := keys(tx, TRIP_UPDATES_BUCKET_NAME, "trip1", STOP_ID_PREFIX+"5"); len(got) != 1 || !bytes.Equal(got[0], TimeKey(1449813630)) {
+			t.Errorf("got prediction keys %x for stop ID 5, want %x", got, TimeKey(1449813630))
+		}
+		if got := keys(tx, BUCKET_NAME, "trip1"); len(got) != 1 || !bytes.Equal(got[0], LocationKey(1449813600, "5001")) {
+			t.Errorf("got location keys %x", got)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,361 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The events notifiers are sent for each capture.
+const (
+	// NOTIFY_START is sent before each capture.
+	NOTIFY_START = "start"
+	// NOTIFY_SUCCESS is sent after each capture which didn't fail.
+	NOTIFY_SUCCESS = "success"
+	// NOTIFY_FAIL is sent once a feed's captures have failed FailAfter times
+	// in a row, and not again until one succeeds.
+	NOTIFY_FAIL = "fail"
+
+	// NOTIFY_TIMEOUT limits each notification, and how long a stopping feed
+	// waits for the notifications it has queued.
+	NOTIFY_TIMEOUT = 10 * time.Second
+	// NOTIFY_QUEUE_SIZE is how many events can wait for a slow notifier
+	// before newer ones are dropped.
+	NOTIFY_QUEUE_SIZE = 16
+)
+
+// The types of notifier.
+const (
+	NOTIFIER_CRONITOR     = "cronitor"
+	NOTIFIER_HEALTHCHECKS = "healthchecks"
+	NOTIFIER_WEBHOOK      = "webhook"
+	NOTIFIER_FILE         = "file"
+	NOTIFIER_UNIX         = "unix"
+)
+
+var notifyClient = http.Client{Timeout: NOTIFY_TIMEOUT}
+
+// CaptureEvent describes a capture of a feed to a notifier.
+type CaptureEvent struct {
+	Feed  string `json:"feed"`
+	Event string `json:"event"`
+	// Outcome is "updated", "empty", "unchanged" or "failed", and is only set
+	// once the capture has finished, as are Duration and Locations.
+	Outcome string    `json:"outcome,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Started time.Time `json:"started"`
+	// Duration is how long the capture took in milliseconds.
+	Duration  int64          `json:"duration_ms,omitempty"`
+	Locations *LocationStats `json:"locations,omitempty"`
+	// FeedTimestamp is the header timestamp of the last feed captured.
+	FeedTimestamp       int64 `json:"feed_timestamp,omitempty"`
+	ConsecutiveFailures int   `json:"consecutive_failures"`
+}
+
+// String summarizes the event in a line, for services which take a message.
+func (e *CaptureEvent) String() string {
+	var parts []string
+	switch {
+	case e.Outcome == "":
+		parts = append(parts, fmt.Sprintf("%s: capture started", e.Feed))
+	default:
+		parts = append(parts, fmt.Sprintf("%s: feed %s in %dms", e.Feed, e.Outcome, e.Duration))
+	}
+	if e.Locations != nil {
+		parts = append(parts, fmt.Sprintf("%d of %d locations stored", e.Locations.Stored, e.Locations.Seen))
+	}
+	if e.ConsecutiveFailures > 0 {
+		parts = append(parts, fmt.Sprintf("failures in a row: %d", e.ConsecutiveFailures))
+	}
+	if e.Error != "" {
+		parts = append(parts, e.Error)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Notifier is told about a feed's captures, e.g. to let a monitoring service
+// know the daemon is still capturing it.
+type Notifier interface {
+	Notify(event *CaptureEvent) error
+}
+
+// NotifierConfig describes a notifier in a config file.
+type NotifierConfig struct {
+	// Type is one of:
+	//
+	//	cronitor      ping a Cronitor telemetry URL with state=run, complete or fail
+	//	healthchecks  ping a healthchecks.io URL, with /start or /fail appended
+	//	webhook       POST each event to URL as JSON
+	//	file          replace the file at Path with each event as JSON
+	//	unix          write each event as a line of JSON to the unix socket at Path
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	// Events limits the events sent to start, success or fail. By default
+	// every event is sent.
+	Events []string `json:"events"`
+}
+
+// NewNotifier returns the notifier described by a config.
+func NewNotifier(config NotifierConfig) (Notifier, error) {
+	var n Notifier
+	switch config.Type {
+	case NOTIFIER_CRONITOR, NOTIFIER_HEALTHCHECKS, NOTIFIER_WEBHOOK:
+		if _, err := url.ParseRequestURI(config.URL); err != nil {
+			return nil, fmt.Errorf("%s notifier needs a valid url, got %q", config.Type, config.URL)
+		}
+		switch config.Type {
+		case NOTIFIER_CRONITOR:
+			n = &cronitorNotifier{url: config.URL}
+		case NOTIFIER_HEALTHCHECKS:
+			n = &healthchecksNotifier{url: strings.TrimSuffix(config.URL, "/")}
+		default:
+			n = &webhookNotifier{url: config.URL, headers: config.Headers}
+		}
+	case NOTIFIER_FILE, NOTIFIER_UNIX:
+		if config.Path == "" {
+			return nil, fmt.Errorf("%s notifier needs a path", config.Type)
+		}
+		if config.Type == NOTIFIER_FILE {
+			n = &fileNotifier{path: config.Path}
+		} else {
+			n = &unixNotifier{path: config.Path}
+		}
+	default:
+		return nil, fmt.Errorf("unknown notifier type: %q", config.Type)
+	}
+
+	if len(config.Events) == 0 {
+		return n, nil
+	}
+	events := map[string]bool{}
+	for _, event := range config.Events {
+		if event != NOTIFY_START && event != NOTIFY_SUCCESS && event != NOTIFY_FAIL {
+			return nil, fmt.Errorf("unknown notifier event: %q", event)
+		}
+		events[event] = true
+	}
+	return &filteredNotifier{Notifier: n, events: events}, nil
+}
+
+// filteredNotifier only passes on some events.
+type filteredNotifier struct {
+	Notifier
+	events map[string]bool
+}
+
+func (n *filteredNotifier) Notify(event *CaptureEvent) error {
+	if !n.events[event.Event] {
+		return nil
+	}
+	return n.Notifier.Notify(event)
+}
+
+// notifierQueue sends events to a notifier from its own goroutine, so a slow
+// or unreachable notifier never holds up captures or the feed's other
+// notifiers. Events are sent in order.
+type notifierQueue struct {
+	feed     string
+	notifier Notifier
+	events   chan *CaptureEvent
+	done     chan struct{}
+}
+
+func newNotifierQueue(feed string, notifier Notifier) *notifierQueue {
+	q := &notifierQueue{
+		feed:     feed,
+		notifier: notifier,
+		events:   make(chan *CaptureEvent, NOTIFY_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *notifierQueue) run() {
+	defer close(q.done)
+	for event := range q.events {
+		if err := q.notifier.Notify(event); err != nil {
+			elog.Printf("[%s] Error sending %s notification: %s\n", q.feed, event.Event, err)
+		}
+	}
+}
+
+// send queues an event, dropping it if the notifier has fallen too far
+// behind.
+func (q *notifierQueue) send(event *CaptureEvent) {
+	select {
+	case q.events <- event:
+	default:
+		elog.Printf("[%s] Dropped %s notification, %d are already waiting to be sent\n", q.feed, event.Event, NOTIFY_QUEUE_SIZE)
+	}
+}
+
+// request sends a notification over HTTP, failing on any status besides 2xx.
+func request(method, rawURL string, headers map[string]string, contentType string, body []byte) error {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return nil
+}
+
+// pingNotifier GETs a URL after each successful capture, which is how
+// cronitor_url has always worked.
+type pingNotifier struct {
+	url string
+}
+
+func (n *pingNotifier) Notify(event *CaptureEvent) error {
+	if event.Event != NOTIFY_SUCCESS {
+		return nil
+	}
+	return request("GET", n.url, nil, "", nil)
+}
+
+// cronitorNotifier pings Cronitor's telemetry API, e.g.
+// https://cronitor.link/p/<api-key>/<monitor-key>, with the state of each
+// capture.
+type cronitorNotifier struct {
+	url string
+}
+
+func (n *cronitorNotifier) Notify(event *CaptureEvent) error {
+	u, err := url.Parse(n.url)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	switch event.Event {
+	case NOTIFY_START:
+		query.Set("state", "run")
+	case NOTIFY_SUCCESS:
+		query.Set("state", "complete")
+	case NOTIFY_FAIL:
+		query.Set("state", "fail")
+	}
+	if event.Event != NOTIFY_START {
+		query.Set("message", event.String())
+	}
+	u.RawQuery = query.Encode()
+
+	return request("GET", u.String(), nil, "", nil)
+}
+
+// healthchecksNotifier pings a healthchecks.io check (or a self-hosted
+// instance), e.g. https://hc-ping.com/<uuid>. A summary of the capture is
+// sent as the body, which shows up in the check's log.
+type healthchecksNotifier struct {
+	url string
+}
+
+func (n *healthchecksNotifier) Notify(event *CaptureEvent) error {
+	target := n.url
+	switch event.Event {
+	case NOTIFY_START:
+		target += "/start"
+	case NOTIFY_FAIL:
+		target += "/fail"
+	}
+	return request("POST", target, nil, "text/plain; charset=utf-8", []byte(event.String()))
+}
+
+// webhookNotifier POSTs each event as JSON.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n *webhookNotifier) Notify(event *CaptureEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return request("POST", n.url, n.headers, "application/json", body)
+}
+
+// fileNotifier replaces a file with each event, so a local watchdog can check
+// its modification time or contents. The file is replaced by renaming, so it's
+// never read half written.
+type fileNotifier struct {
+	path string
+}
+
+func (n *fileNotifier) Notify(event *CaptureEvent) error {
+	data, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(n.path), filepath.Base(n.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), n.path)
+}
+
+// unixNotifier writes each event as a line of JSON to a unix socket, either a
+// stream or a datagram socket.
+type unixNotifier struct {
+	path string
+}
+
+func (n *unixNotifier) Notify(event *CaptureEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("unix", n.path, NOTIFY_TIMEOUT)
+	if err != nil {
+		// a datagram socket refuses stream connections
+		var gramErr error
+		if conn, gramErr = net.DialTimeout("unixgram", n.path, NOTIFY_TIMEOUT); gramErr != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(NOTIFY_TIMEOUT))
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,403 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// received is a request received by a stand-in for a monitoring service.
+type received struct {
+	method string
+	path   string
+	query  map[string]string
+	header http.Header
+	body   string
+}
+
+// standIn starts an HTTP server which records the requests it receives.
+func standIn(t *testing.T) (*httptest.Server, func() []received) {
+	var mu sync.Mutex
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %s", err)
+		}
+		query := map[string]string{}
+		for name := range r.URL.Query() {
+			query[name] = r.URL.Query().Get(name)
+		}
+
+		mu.Lock()
+		requests = append(requests, received{r.Method, r.URL.Path, query, r.Header, string(body)})
+		mu.Unlock()
+	}))
+	return server, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received{}, requests...)
+	}
+}
+
+func captureEvent(event string) *CaptureEvent {
+	e := &CaptureEvent{Feed: "capmetro", Event: event, Started: time.Unix(1449813600, 0)}
+	switch event {
+	case NOTIFY_SUCCESS:
+		e.Outcome = captureUpdated.String()
+		e.Duration = 120
+		e.Locations = &LocationStats{Seen: 10, Valid: 9, Stored: 8, Trips: 4}
+	case NOTIFY_FAIL:
+		e.Outcome = captureFailed.String()
+		e.Error = "unexpected status: 503 Service Unavailable"
+		e.ConsecutiveFailures = 3
+	}
+	return e
+}
+
+func newTestNotifier(t *testing.T, config NotifierConfig) Notifier {
+	n, err := NewNotifier(config)
+	if err != nil {
+		t.Fatalf("NewNotifier(%+v): %s", config, err)
+	}
+	return n
+}
+
+func TestCronitorNotifier(t *testing.T) {
+	server, requests := standIn(t)
+	defer server.Close()
+	n := newTestNotifier(t, NotifierConfig{Type: NOTIFIER_CRONITOR, URL: server.URL + "/p/key/monitor?env=test"})
+
+	events := []struct {
+		event, state string
+	}{
+		{NOTIFY_START, "run"},
+		{NOTIFY_SUCCESS, "complete"},
+		{NOTIFY_FAIL, "fail"},
+	}
+	for _, e := range events {
+		if err := n.Notify(captureEvent(e.event)); err != nil {
+			t.Fatalf("notifying %s: %s", e.event, err)
+		}
+	}
+
+	got := requests()
+	if len(got) != len(events) {
+		t.Fatalf("got %d requests, want %d", len(got), len(events))
+	}
+	for i, e := range events {
+		r := got[i]
+		if r.method != "GET" || r.path != "/p/key/monitor" {
+			t.Errorf("%s: got %s %s, want GET /p/key/monitor", e.event, r.method, r.path)
+		}
+		if r.query["state"] != e.state {
+			t.Errorf("%s: got state=%q, want %q", e.event, r.query["state"], e.state)
+		}
+		if r.query["env"] != "test" {
+			t.Errorf("%s: query parameters of the URL were dropped: %v", e.event, r.query)
+		}
+		if _, ok := r.query["message"]; ok == (e.event == NOTIFY_START) {
+			t.Errorf("%s: got message %q", e.event, r.query["message"])
+		}
+	}
+	if msg := got[2].query["message"]; !strings.Contains(msg, "503 Service Unavailable") || !strings.Contains(msg, "failures in a row: 3") {
+		t.Errorf("fail message doesn't describe the failure: %q", msg)
+	}
+}
+
+func TestHealthchecksNotifier(t *testing.T) {
+	server, requests := standIn(t)
+	defer server.Close()
+	n := newTestNotifier(t, NotifierConfig{Type: NOTIFIER_HEALTHCHECKS, URL: server.URL + "/uuid/"})
+
+	events := []struct {
+		event, path string
+	}{
+		{NOTIFY_START, "/uuid/start"},
+		{NOTIFY_SUCCESS, "/uuid"},
+		{NOTIFY_FAIL, "/uuid/fail"},
+	}
+	for _, e := range events {
+		if err := n.Notify(captureEvent(e.event)); err != nil {
+			t.Fatalf("notifying %s: %s", e.event, err)
+		}
+	}
+
+	got := requests()
+	if len(got) != len(events) {
+		t.Fatalf("got %d requests, want %d", len(got), len(events))
+	}
+	for i, e := range events {
+		r := got[i]
+		if r.method != "POST" || r.path != e.path {
+			t.Errorf("%s: got %s %s, want POST %s", e.event, r.method, r.path, e.path)
+		}
+		if want := captureEvent(e.event).String(); r.body != want {
+			t.Errorf("%s: got body %q, want %q", e.event, r.body, want)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server, requests := standIn(t)
+	defer server.Close()
+	n := newTestNotifier(t, NotifierConfig{
+		Type:    NOTIFIER_WEBHOOK,
+		URL:     server.URL + "/hooks/capmetricsd",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	})
+
+	if err := n.Notify(captureEvent(NOTIFY_SUCCESS)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(got))
+	}
+	r := got[0]
+	if r.method != "POST" || r.path != "/hooks/capmetricsd" {
+		t.Errorf("got %s %s, want POST /hooks/capmetricsd", r.method, r.path)
+	}
+	if auth := r.header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("got Authorization %q, want %q", auth, "Bearer secret")
+	}
+	if contentType := r.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(r.body), &body); err != nil {
+		t.Fatalf("body isn't JSON: %s: %q", err, r.body)
+	}
+	want := map[string]interface{}{
+		"feed":                 "capmetro",
+		"event":                "success",
+		"outcome":              "updated",
+		"started":              time.Unix(1449813600, 0).Format(time.RFC3339Nano),
+		"duration_ms":          120.0,
+		"consecutive_failures": 0.0,
+	}
+	for name, value := range want {
+		if body[name] != value {
+			t.Errorf("got %s %#v, want %#v", name, body[name], value)
+		}
+	}
+	locations, _ := body["locations"].(map[string]interface{})
+	if locations["stored"] != 8.0 || locations["seen"] != 10.0 {
+		t.Errorf("got locations %#v", body["locations"])
+	}
+	if _, ok := body["error"]; ok {
+		t.Errorf("successful capture has an error: %#v", body["error"])
+	}
+}
+
+func TestNotifierStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	for _, notifierType := range []string{NOTIFIER_CRONITOR, NOTIFIER_HEALTHCHECKS, NOTIFIER_WEBHOOK} {
+		n := newTestNotifier(t, NotifierConfig{Type: notifierType, URL: server.URL})
+		if err := n.Notify(captureEvent(NOTIFY_SUCCESS)); err == nil {
+			t.Errorf("%s notifier: no error for a 502", notifierType)
+		}
+	}
+}
+
+func TestNotifierEvents(t *testing.T) {
+	server, requests := standIn(t)
+	defer server.Close()
+	n := newTestNotifier(t, NotifierConfig{Type: NOTIFIER_WEBHOOK, URL: server.URL, Events: []string{NOTIFY_FAIL}})
+
+	for _, event := range []string{NOTIFY_START, NOTIFY_SUCCESS, NOTIFY_FAIL} {
+		if err := n.Notify(captureEvent(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := requests()
+	if len(got) != 1 || !strings.Contains(got[0].body, `"event":"fail"`) {
+		t.Errorf("got %d requests, want only the fail event: %+v", len(got), got)
+	}
+
+	if _, err := NewNotifier(NotifierConfig{Type: NOTIFIER_WEBHOOK, URL: server.URL, Events: []string{"finish"}}); err == nil {
+		t.Error("no error for an unknown event")
+	}
+}
+
+// recorder records the events it's sent.
+type recorder struct {
+	events []*CaptureEvent
+}
+
+func (r *recorder) Notify(event *CaptureEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestReportFailAfter(t *testing.T) {
+	r := &recorder{}
+	config := FeedConfig{Name: "capmetro", VehiclePositionsURL: "http://localhost/vp", FailAfter: 2}
+	config.notifiers = []Notifier{r}
+	f := newFeed(config)
+
+	outcomes := []struct {
+		outcome captureOutcome
+		// event is the event notifiers should be sent, if any
+		event    string
+		failures int
+	}{
+		{captureFailed, "", 1},
+		{captureFailed, NOTIFY_FAIL, 2},
+		{captureFailed, "", 3},
+		{captureFailed, "", 4},
+		{captureUpdated, NOTIFY_SUCCESS, 0},
+		{captureFailed, "", 1},
+		{captureUnchanged, NOTIFY_SUCCESS, 0},
+		{captureFailed, "", 1},
+		{captureFailed, NOTIFY_FAIL, 2},
+	}
+	for i, o := range outcomes {
+		sent := len(r.events)
+		f.report(o.outcome, time.Now())
+		f.stopNotifiers()
+
+		if f.failures != o.failures {
+			t.Errorf("capture %d: got %d failures in a row, want %d", i, f.failures, o.failures)
+		}
+		switch {
+		case o.event == "" && len(r.events) != sent:
+			t.Errorf("capture %d: sent %s, want nothing", i, r.events[sent].Event)
+		case o.event != "" && len(r.events) != sent+1:
+			t.Errorf("capture %d: sent %d events, want %s", i, len(r.events)-sent, o.event)
+		case o.event != "":
+			event := r.events[sent]
+			if event.Event != o.event || event.ConsecutiveFailures != o.failures {
+				t.Errorf("capture %d: sent %s with %d failures, want %s with %d", i, event.Event, event.ConsecutiveFailures, o.event, o.failures)
+			}
+		}
+	}
+}
+
+// blocker is a notifier which doesn't return until it's released.
+type blocker struct {
+	release chan struct{}
+	sent    int
+}
+
+func (b *blocker) Notify(event *CaptureEvent) error {
+	<-b.release
+	b.sent++
+	return nil
+}
+
+func TestNotifyDoesNotWait(t *testing.T) {
+	b := &blocker{release: make(chan struct{})}
+	r := &recorder{}
+	config := FeedConfig{Name: "capmetro", VehiclePositionsURL: "http://localhost/vp"}
+	config.notifiers = []Notifier{b, r}
+	f := newFeed(config)
+
+	reported := make(chan struct{})
+	go func() {
+		for i := 0; i < NOTIFY_QUEUE_SIZE; i++ {
+			f.report(captureUpdated, time.Now())
+		}
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("captures waited on a notifier")
+	}
+
+	close(b.release)
+	f.stopNotifiers()
+	if b.sent != NOTIFY_QUEUE_SIZE || len(r.events) != NOTIFY_QUEUE_SIZE {
+		t.Errorf("notifiers were sent %d and %d events, want %d", b.sent, len(r.events), NOTIFY_QUEUE_SIZE)
+	}
+}
+
+// systemdStandIn listens on a notify socket like systemd's, returning a
+// notifier sending to it and a func returning the next message received.
+func systemdStandIn(t *testing.T) (*systemdNotifier, func() string, func()) {
+	dir, err := ioutil.TempDir("", "capmetricsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	next := func() string {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	return &systemdNotifier{socket: path}, next, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	n, next, cleanup := systemdStandIn(t)
+	defer cleanup()
+
+	states := func(msg string) map[string]bool {
+		set := map[string]bool{}
+		for _, line := range strings.Split(msg, "\n") {
+			if !strings.HasPrefix(line, "STATUS=") {
+				set[line] = true
+			}
+		}
+		return set
+	}
+
+	steps := []struct {
+		name   string
+		send   func()
+		want   []string
+		absent []string
+	}{
+		{"failed capture", func() { n.Notify(captureEvent(NOTIFY_FAIL)) }, []string{"WATCHDOG=1"}, []string{"READY=1"}},
+		{"first success", func() { n.Notify(captureEvent(NOTIFY_SUCCESS)) }, []string{"WATCHDOG=1", "READY=1"}, nil},
+		{"later success", func() { n.Notify(captureEvent(NOTIFY_SUCCESS)) }, []string{"WATCHDOG=1"}, []string{"READY=1"}},
+		{"reloading", n.reloading, []string{"RELOADING=1"}, nil},
+		// a capture finishing while the old feeds stop
+		{"success while reloading", func() { n.Notify(captureEvent(NOTIFY_SUCCESS)) }, []string{"WATCHDOG=1"}, []string{"READY=1"}},
+		{"success after reloading", func() {
+			n.reloaded()
+			n.Notify(captureEvent(NOTIFY_SUCCESS))
+		}, []string{"WATCHDOG=1", "READY=1"}, nil},
+	}
+	for _, step := range steps {
+		step.send()
+		got := states(next())
+		for _, state := range step.want {
+			if !got[state] {
+				t.Errorf("%s: %s wasn't sent, got %v", step.name, state, got)
+			}
+		}
+		for _, state := range step.absent {
+			if got[state] {
+				t.Errorf("%s: %s was sent", step.name, state)
+			}
+		}
+	}
+}
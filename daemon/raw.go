@@ -0,0 +1,296 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The kinds of feed archived in the raw_feeds bucket, each in its own nested
+// bucket.
+const (
+	RAW_VEHICLE_POSITIONS = "vehicle_positions"
+	RAW_TRIP_UPDATES      = "trip_updates"
+	RAW_ALERTS            = "alerts"
+
+	// REPROCESS_BATCH_SIZE is the number of raw feeds replayed per
+	// transaction by Reprocess.
+	REPROCESS_BATCH_SIZE = 50
+)
+
+// RawFeedKey returns the key a raw feed is archived under: the timestamp of
+// its header followed by a SHA-256 hash of its content. A feed fetched again
+// without changes has the same key, so it's only stored once.
+func RawFeedKey(ts int64, pb []byte) []byte {
+	hash := sha256.Sum256(pb)
+	return append(TimeKey(ts), hash[:]...)
+}
+
+// feedHeaderTime returns the timestamp in the header of an encoded
+// FeedMessage, without decoding its entities.
+func feedHeaderTime(pb []byte) (ts int64, ok bool) {
+	buf := proto.NewBuffer(pb)
+	for {
+		tag, err := buf.DecodeVarint()
+		if err != nil {
+			return 0, false
+		}
+
+		field, wireType := tag>>3, tag&7
+		switch wireType {
+		case proto.WireVarint:
+			_, err = buf.DecodeVarint()
+		case proto.WireFixed64:
+			_, err = buf.DecodeFixed64()
+		case proto.WireFixed32:
+			_, err = buf.DecodeFixed32()
+		case proto.WireBytes:
+			var data []byte
+			data, err = buf.DecodeRawBytes(false)
+			if err == nil && field == 1 {
+				header := new(gtfsrt.FeedHeader)
+				if err = proto.Unmarshal(data, header); err != nil || header.Timestamp == nil {
+					return 0, false
+				}
+				return int64(header.GetTimestamp()), true
+			}
+		default:
+			return 0, false
+		}
+		if err != nil {
+			return 0, false
+		}
+	}
+}
+
+// ArchiveRawFeed stores a fetched feed of the given kind as-is, compressed
+// with gzip, so the data derived from it can be rebuilt later with Reprocess.
+// Feeds are keyed by their header's timestamp, or the time they were fetched
+// if they don't have one.
+func ArchiveRawFeed(db *bolt.DB, kind string, pb []byte) (err error) {
+	ts, ok := feedHeaderTime(pb)
+	if !ok {
+		ts = time.Now().Unix()
+	}
+	key := RawFeedKey(ts, pb)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err = gz.Write(pb); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+
+	stored := false
+	err = updateWithRetry(db, func(tx *bolt.Tx) error {
+		rawBucket, err := tx.CreateBucketIfNotExists([]byte(RAW_FEEDS_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+		kindBucket, err := rawBucket.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+
+		stored = false
+		if kindBucket.Get(key) != nil {
+			return nil
+		}
+		stored = true
+		return kindBucket.Put(key, compressed.Bytes())
+	})
+	if err != nil {
+		return fmt.Errorf("Error archiving raw %s feed: %s", kind, err)
+	}
+
+	if stored {
+		dlog.Printf("Archived raw %s feed: %d bytes, %d compressed\n", kind, len(pb), compressed.Len())
+	} else {
+		dlog.Printf("Raw %s feed from %s is already archived\n", kind, time.Unix(ts, 0).Format(ISO8601_FORMAT))
+	}
+	return nil
+}
+
+// readRawFeed decompresses an archived raw feed.
+func readRawFeed(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// rawFeedKeys returns the keys of a database's archived raw Vehicle Positions
+// feeds, in time order.
+func rawFeedKeys(db *bolt.DB) (keys [][]byte, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		if err := CheckKeyFormat(tx); err != nil {
+			return err
+		}
+		kindBucket := rawFeedsBucket(tx, RAW_VEHICLE_POSITIONS)
+		if kindBucket == nil {
+			return nil
+		}
+		return kindBucket.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("no raw Vehicle Positions feeds are archived, start the daemon with raw archival enabled first")
+	}
+	return
+}
+
+// replayRawFeeds decodes the raw Vehicle Positions feeds of src with the given
+// keys and stores their locations in dst, a batch of feeds per transaction. It
+// returns the number of locations stored.
+func replayRawFeeds(src, dst *bolt.DB, keys [][]byte) (count int, err error) {
+	skipped := 0
+	for start := 0; start < len(keys); start += REPROCESS_BATCH_SIZE {
+		end := start + REPROCESS_BATCH_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var feeds []*gtfsrt.FeedMessage
+		err = src.View(func(tx *bolt.Tx) error {
+			kindBucket := rawFeedsBucket(tx, RAW_VEHICLE_POSITIONS)
+			for _, key := range keys[start:end] {
+				pb, err := readRawFeed(kindBucket.Get(key))
+				if err != nil {
+					return fmt.Errorf("Error reading raw feed from %s: %s", time.Unix(KeyTime(key), 0).Format(ISO8601_FORMAT), err)
+				}
+
+				fm := new(gtfsrt.FeedMessage)
+				if err = proto.Unmarshal(pb, fm); err != nil {
+					elog.Printf("Skipping raw feed from %s which can't be decoded: %s\n", time.Unix(KeyTime(key), 0).Format(ISO8601_FORMAT), err)
+					continue
+				}
+				feeds = append(feeds, fm)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		stored, failed := 0, 0
+		err = dst.Update(func(tx *bolt.Tx) error {
+			stored, failed = 0, 0
+			for _, fm := range feeds {
+				tripBins, _ := binLocations(filterLocations(vehicleLocations(fm)))
+				for trip, locations := range tripBins {
+					for _, location := range locations {
+						err := storeSingleLocation([]byte(trip), location, tx)
+						if permanentErrors[err] {
+							failed++
+							continue
+						}
+						if err != nil {
+							return err
+						}
+						stored++
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		count += stored
+		skipped += failed
+		dlog.Printf("Reprocessed %d of %d raw feeds\n", end, len(keys))
+	}
+
+	if skipped > 0 {
+		elog.Printf("%d locations couldn't be stored and were skipped\n", skipped)
+	}
+	return
+}
+
+// Reprocess decodes the archived raw Vehicle Positions feeds again, e.g. after
+// fixing a bug in decoding them, and stores their locations over those
+// already stored under the same keys. Nothing is deleted, so locations
+// captured while raw feeds weren't being archived are kept, as are any stored
+// under a trip or vehicle the fix changed. It returns the number of locations
+// stored. If it's interrupted, running it again finishes the job.
+func Reprocess(db *bolt.DB) (count int, err error) {
+	keys, err := rawFeedKeys(db)
+	if err != nil {
+		return
+	}
+	return replayRawFeeds(db, db, keys)
+}
+
+// ReprocessFile rebuilds the vehicle_locations bucket and its indexes from the
+// archived raw Vehicle Positions feeds, replacing every stored location, so
+// locations captured while raw feeds weren't being archived are lost. The
+// database at path is copied to a new file without its locations, the raw
+// feeds are replayed into it and it replaces the original once they all have
+// been, so the original is left as it was if reprocessing is interrupted. db
+// must be the open database at path, which is closed. It returns the number of
+// locations stored.
+func ReprocessFile(db *bolt.DB, path string) (count int, err error) {
+	keys, err := rawFeedKeys(db)
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	// a copy left by a run which was interrupted is incomplete
+	tmpPath := path + ".reprocess"
+	if err = os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		db.Close()
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	skip := map[string]bool{BUCKET_NAME: true, TIME_INDEX_BUCKET_NAME: true, ROUTE_INDEX_BUCKET_NAME: true, VEHICLE_INDEX_BUCKET_NAME: true}
+	if err = compactExcept(db, tmpPath, skip); err != nil {
+		db.Close()
+		return
+	}
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		db.Close()
+		return
+	}
+	// locations are stored in a new vehicle_locations bucket, which marks the
+	// indexes complete since every location is indexed as it's stored
+	count, err = replayRawFeeds(db, dst, keys)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpPath, path)
+	return
+}
+
+func rawFeedsBucket(tx *bolt.Tx, kind string) *bolt.Bucket {
+	rawBucket := tx.Bucket([]byte(RAW_FEEDS_BUCKET_NAME))
+	if rawBucket == nil {
+		return nil
+	}
+	return rawBucket.Bucket([]byte(kind))
+}
@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// archiveVehiclePosition archives a raw feed holding a single vehicle
+// position.
+func archiveVehiclePosition(t *testing.T, db *bolt.DB, trip, vehicle, route string, ts int64, lat float32) {
+	fm := &gtfsrt.FeedMessage{
+		Header: &gtfsrt.FeedHeader{GtfsRealtimeVersion: proto.String("1.0"), Timestamp: proto.Uint64(uint64(ts))},
+		Entity: []*gtfsrt.FeedEntity{{
+			Id: proto.String(vehicle),
+			Vehicle: &gtfsrt.VehiclePosition{
+				Trip:      &gtfsrt.TripDescriptor{TripId: proto.String(trip), RouteId: proto.String(route)},
+				Vehicle:   &gtfsrt.VehicleDescriptor{Id: proto.String(vehicle)},
+				Position:  &gtfsrt.Position{Latitude: proto.Float32(lat), Longitude: proto.Float32(-97.7)},
+				Timestamp: proto.Uint64(uint64(ts)),
+			},
+		}},
+	}
+	if err := ArchiveRawFeed(db, RAW_VEHICLE_POSITIONS, marshal(t, fm)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reprocessDB returns a database holding a location captured before raw feeds
+// were archived, and one decoded wrongly from an archived raw feed.
+func reprocessDB(t *testing.T) (*bolt.DB, func()) {
+	db, cleanup := tempDB(t)
+	if err := PrepareDB(db); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		storeLocation(t, tx, "tripX", "v9", "803", 1449813000)
+		storeLocation(t, tx, "tripA", "v1", "801", 1449813600)
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	archiveVehiclePosition(t, db, "tripA", "v1", "801", 1449813600, 30.25)
+	return db, cleanup
+}
+
+// latitude returns the latitude of a stored location, or 0 if there isn't one.
+func latitude(t *testing.T, tx *bolt.Tx, trip, vehicle string, ts int64) float32 {
+	b := tx.Bucket([]byte(BUCKET_NAME)).Bucket([]byte(trip))
+	if b == nil || b.Get(LocationKey(ts, vehicle)) == nil {
+		return 0
+	}
+	var location gtfsrt.VehicleLocation
+	if err := proto.Unmarshal(b.Get(LocationKey(ts, vehicle)), &location); err != nil {
+		t.Fatal(err)
+	}
+	return location.GetLatitude()
+}
+
+func TestReprocess(t *testing.T) {
+	db, cleanup := reprocessDB(t)
+	defer cleanup()
+
+	count, err := Reprocess(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("stored %d locations, want 1", count)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if lat := latitude(t, tx, "tripA", "v1", 1449813600); lat != 30.25 {
+			t.Errorf("reprocessed location has latitude %v, want 30.25", lat)
+		}
+		if tx.Bucket([]byte(BUCKET_NAME)).Bucket([]byte("tripX")) == nil {
+			t.Error("location captured before raw feeds were archived was deleted")
+		}
+		if !IndexesComplete(tx) {
+			t.Error("indexes aren't complete after reprocessing")
+		}
+		return nil
+	})
+}
+
+func TestReprocessFile(t *testing.T) {
+	db, cleanup := reprocessDB(t)
+	defer cleanup()
+	path := db.Path()
+
+	// a copy left by an interrupted run is thrown away
+	if err := ioutil.WriteFile(path+".reprocess", []byte("incomplete"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := ReprocessFile(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("stored %d locations, want 1", count)
+	}
+	if _, err := os.Stat(path + ".reprocess"); !os.IsNotExist(err) {
+		t.Errorf("copy wasn't moved into place: %v", err)
+	}
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if err := CheckKeyFormat(tx); err != nil {
+			t.Errorf("key format after reprocessing: %s", err)
+		}
+		if lat := latitude(t, tx, "tripA", "v1", 1449813600); lat != 30.25 {
+			t.Errorf("reprocessed location has latitude %v, want 30.25", lat)
+		}
+		if tx.Bucket([]byte(BUCKET_NAME)).Bucket([]byte("tripX")) != nil {
+			t.Error("location which isn't in a raw feed wasn't replaced")
+		}
+		if got := keys(tx, VEHICLE_INDEX_BUCKET_NAME, "v9"); len(got) != 0 {
+			t.Errorf("replaced location is still in the vehicle index: %x", got)
+		}
+		if !IndexesComplete(tx) {
+			t.Error("indexes aren't complete after reprocessing")
+		}
+		if got := keys(tx, RAW_FEEDS_BUCKET_NAME, RAW_VEHICLE_POSITIONS); len(got) != 1 {
+			t.Errorf("got %d raw feeds after reprocessing, want 1", len(got))
+		}
+		return nil
+	})
+}
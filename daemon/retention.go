@@ -0,0 +1,713 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PRUNE_INTERVAL is how often the daemon prunes a feed with a retention
+	// period.
+	PRUNE_INTERVAL = 24 * time.Hour
+	// PRUNE_BATCH_SIZE is the number of trips deleted per transaction by
+	// Prune.
+	PRUNE_BATCH_SIZE = 100
+	// COMPACT_TX_SIZE is roughly how many bytes Compact writes per
+	// transaction, to bound its memory use.
+	COMPACT_TX_SIZE = 64 * 1024 * 1024
+	// COMPACT_MIN_FREE is the fraction of a database's file which has to be
+	// free before the daemon compacts it after pruning.
+	COMPACT_MIN_FREE = 0.25
+
+	lastPrunedKey = "last_pruned"
+)
+
+// ParseDuration parses a duration like time.ParseDuration, also accepting a
+// whole number of days such as "90d".
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// PruneStats counts what Prune deleted.
+type PruneStats struct {
+	Locations int
+	// Trips counts the trips whose locations were all deleted.
+	Trips       int
+	Predictions int
+	// TripUpdates counts the trips whose predictions were all deleted.
+	TripUpdates int
+	Alerts      int
+	RawFeeds    int
+}
+
+func (s PruneStats) String() string {
+	return fmt.Sprintf("%d locations (emptying %d trips), %d stop time predictions (emptying %d trips), %d alerts and %d raw feeds",
+		s.Locations, s.Trips, s.Predictions, s.TripUpdates, s.Alerts, s.RawFeeds)
+}
+
+// Prune deletes the data in a database older than cutoff, a POSIX time:
+//
+//   - locations from before it, along with their index entries
+//   - stop time predictions from before it
+//   - alerts last seen before it
+//   - raw feeds from before it
+//
+// Trips are keyed by their GTFS trip_id, which repeats every day a trip is
+// scheduled, so the bucket of a trip which still runs is kept and only its old
+// data is deleted. Buckets are deleted once they're empty.
+//
+// Trips are pruned a batch per transaction, so a prune which is interrupted
+// leaves the database consistent and can be run again. Bolt doesn't shrink its
+// file as data is deleted, but reuses the space freed; Compact reclaims it.
+func Prune(db *bolt.DB, cutoff int64) (stats PruneStats, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		return CheckKeyFormat(tx)
+	})
+	if err != nil {
+		return
+	}
+
+	trips, err := oldTrips(db, BUCKET_NAME, cutoff, oldestKey)
+	if err != nil {
+		return
+	}
+	for start := 0; start < len(trips); start += PRUNE_BATCH_SIZE {
+		end := start + PRUNE_BATCH_SIZE
+		if end > len(trips) {
+			end = len(trips)
+		}
+
+		var batch PruneStats
+		err = db.Update(func(tx *bolt.Tx) error {
+			batch = PruneStats{}
+			for _, tripID := range trips[start:end] {
+				count, emptied, err := pruneTrip(tx, tripID, cutoff)
+				if err != nil {
+					return err
+				}
+				batch.Locations += count
+				if emptied {
+					batch.Trips++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		stats.Locations += batch.Locations
+		stats.Trips += batch.Trips
+		dlog.Printf("Pruned %d of %d trips\n", end, len(trips))
+	}
+
+	updateTrips, err := oldTrips(db, TRIP_UPDATES_BUCKET_NAME, cutoff, oldestPrediction)
+	if err != nil {
+		return
+	}
+	for start := 0; start < len(updateTrips); start += PRUNE_BATCH_SIZE {
+		end := start + PRUNE_BATCH_SIZE
+		if end > len(updateTrips) {
+			end = len(updateTrips)
+		}
+
+		var batch PruneStats
+		err = db.Update(func(tx *bolt.Tx) error {
+			batch = PruneStats{}
+			for _, tripID := range updateTrips[start:end] {
+				count, emptied, err := pruneTripUpdates(tx, tripID, cutoff)
+				if err != nil {
+					return err
+				}
+				batch.Predictions += count
+				if emptied {
+					batch.TripUpdates++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		stats.Predictions += batch.Predictions
+		stats.TripUpdates += batch.TripUpdates
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if stats.Alerts, err = pruneAlerts(tx, cutoff); err != nil {
+			return err
+		}
+		stats.RawFeeds, err = pruneRawFeeds(tx, cutoff)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, index := range []string{TIME_INDEX_BUCKET_NAME, ROUTE_INDEX_BUCKET_NAME, VEHICLE_INDEX_BUCKET_NAME, ALERT_ROUTES_BUCKET_NAME} {
+			if err := deleteEmptyBuckets(tx, index); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(lastPrunedKey), []byte(time.Now().Format(ISO8601_FORMAT)))
+	})
+	return
+}
+
+// LastPruned returns when the database was last pruned, or the zero time if it
+// never has been.
+func LastPruned(db *bolt.DB) (pruned time.Time, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(META_BUCKET_NAME))
+		if meta == nil {
+			return nil
+		}
+		value := meta.Get([]byte(lastPrunedKey))
+		if value == nil {
+			return nil
+		}
+		var err error
+		pruned, err = time.Parse(ISO8601_FORMAT, string(value))
+		return err
+	})
+	return
+}
+
+// FreeSpace returns the number of bytes in a database's file which Bolt has
+// freed and would be given back to the filesystem by compacting it.
+func FreeSpace(db *bolt.DB) int64 {
+	stats := db.Stats()
+	return int64(stats.FreePageN+stats.PendingPageN) * int64(db.Info().PageSize)
+}
+
+// oldestKey returns the time of the first key in a trip's bucket of locations,
+// or -1 if it's empty.
+func oldestKey(tripBucket *bolt.Bucket) int64 {
+	k, _ := tripBucket.Cursor().First()
+	if k == nil {
+		return -1
+	}
+	return KeyTime(k)
+}
+
+// oldestPrediction returns the time of the oldest prediction for any stop of
+// a trip, or -1 if it has none.
+func oldestPrediction(tripBucket *bolt.Bucket) int64 {
+	oldest := int64(-1)
+	tripBucket.ForEach(func(stop, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		if stopBucket := tripBucket.Bucket(stop); stopBucket != nil {
+			if k, _ := stopBucket.Cursor().First(); k != nil && (oldest < 0 || KeyTime(k) < oldest) {
+				oldest = KeyTime(k)
+			}
+		}
+		return nil
+	})
+	return oldest
+}
+
+// oldTrips returns the IDs of the trips in a bucket of trip buckets whose
+// oldest data, as found by oldest, is older than cutoff.
+func oldTrips(db *bolt.DB, bucket string, cutoff int64, oldest func(*bolt.Bucket) int64) (trips [][]byte, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		topBucket := tx.Bucket([]byte(bucket))
+		if topBucket == nil {
+			return nil
+		}
+		return topBucket.ForEach(func(tripID, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			if ts := oldest(topBucket.Bucket(tripID)); ts >= 0 && ts < cutoff {
+				trips = append(trips, append([]byte{}, tripID...))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// keysBefore returns the keys of a bucket keyed by time which are older than
+// cutoff, and the first key which isn't, if any.
+func keysBefore(b *bolt.Bucket, cutoff int64) (keys [][]byte, next []byte) {
+	c := b.Cursor()
+	k, _ := c.First()
+	for ; k != nil && bytes.Compare(k, TimeKey(cutoff)) < 0; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	if k != nil {
+		next = append([]byte{}, k...)
+	}
+	return
+}
+
+// pruneTrip deletes a trip's locations older than cutoff and their entries in
+// each of the indexes, and the trip's bucket if none are left. It returns the
+// number of locations deleted and whether the bucket was.
+func pruneTrip(tx *bolt.Tx, tripID []byte, cutoff int64) (count int, emptied bool, err error) {
+	topBucket := tx.Bucket([]byte(BUCKET_NAME))
+	tripBucket := topBucket.Bucket(tripID)
+	if tripBucket == nil {
+		return 0, false, nil
+	}
+
+	keys, next := keysBefore(tripBucket, cutoff)
+	if len(keys) == 0 {
+		return 0, false, nil
+	}
+
+	hours := map[string]bool{}
+	routes := map[string]bool{}
+	for _, key := range keys {
+		var location gtfsrt.VehicleLocation
+		if err = proto.Unmarshal(tripBucket.Get(key), &location); err != nil {
+			return
+		}
+		hours[string(TimeIndexKey(location.GetTimestamp()))] = true
+		if route := location.GetRouteId(); route != "" {
+			routes[route] = true
+		}
+	}
+
+	// the trip stays in the indexes for the hours and routes of the locations
+	// it keeps. Those are all at or after the cutoff, so only the first of them
+	// can share an hour with a deleted location.
+	if next != nil {
+		delete(hours, string(TimeIndexKey(KeyTime(next))))
+		c := tripBucket.Cursor()
+		for k, v := c.Seek(next); k != nil && len(routes) > 0; k, v = c.Next() {
+			var location gtfsrt.VehicleLocation
+			if err = proto.Unmarshal(v, &location); err != nil {
+				return
+			}
+			delete(routes, location.GetRouteId())
+		}
+	}
+
+	for hour := range hours {
+		if err = deleteIndexEntry(tx, TIME_INDEX_BUCKET_NAME, []byte(hour), tripID); err != nil {
+			return
+		}
+	}
+	for route := range routes {
+		if err = deleteIndexEntry(tx, ROUTE_INDEX_BUCKET_NAME, []byte(route), tripID); err != nil {
+			return
+		}
+	}
+	for _, key := range keys {
+		if _, vehicle := SplitLocationKey(key); vehicle != "" {
+			if err = deleteIndexEntry(tx, VEHICLE_INDEX_BUCKET_NAME, []byte(vehicle), VehicleIndexKey(key, tripID)); err != nil {
+				return
+			}
+		}
+	}
+
+	if next == nil {
+		return len(keys), true, topBucket.DeleteBucket(tripID)
+	}
+	for _, key := range keys {
+		if err = tripBucket.Delete(key); err != nil {
+			return
+		}
+	}
+	return len(keys), false, nil
+}
+
+// pruneTripUpdates deletes a trip's stop time predictions older than cutoff,
+// along with the bucket of each stop left without any, and the trip's bucket
+// if none are left. It returns the number of predictions deleted and whether
+// the trip's bucket was.
+func pruneTripUpdates(tx *bolt.Tx, tripID []byte, cutoff int64) (count int, emptied bool, err error) {
+	topBucket := tx.Bucket([]byte(TRIP_UPDATES_BUCKET_NAME))
+	tripBucket := topBucket.Bucket(tripID)
+	if tripBucket == nil {
+		return 0, false, nil
+	}
+
+	// which buckets end up empty is worked out before anything is deleted,
+	// since cursors can't be trusted to tell after
+	var stops [][]byte
+	tripBucket.ForEach(func(stop, v []byte) error {
+		if v == nil {
+			stops = append(stops, append([]byte{}, stop...))
+		}
+		return nil
+	})
+	old := make([][][]byte, len(stops))
+	kept := make([]bool, len(stops))
+	remaining := 0
+	for i, stop := range stops {
+		var next []byte
+		old[i], next = keysBefore(tripBucket.Bucket(stop), cutoff)
+		count += len(old[i])
+		if kept[i] = next != nil; kept[i] {
+			remaining++
+		}
+	}
+
+	if remaining == 0 {
+		return count, true, topBucket.DeleteBucket(tripID)
+	}
+	for i, stop := range stops {
+		if len(old[i]) == 0 {
+			continue
+		}
+		if !kept[i] {
+			if err = tripBucket.DeleteBucket(stop); err != nil {
+				return
+			}
+			continue
+		}
+		stopBucket := tripBucket.Bucket(stop)
+		for _, key := range old[i] {
+			if err = stopBucket.Delete(key); err != nil {
+				return
+			}
+		}
+	}
+	return count, false, nil
+}
+
+// deleteIndexEntry removes a key from a bucket of an index.
+func deleteIndexEntry(tx *bolt.Tx, index string, bucket, key []byte) error {
+	indexBucket := tx.Bucket([]byte(index))
+	if indexBucket == nil {
+		return nil
+	}
+	b := indexBucket.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+// deleteEmptyBuckets deletes the buckets of an index left empty by pruning.
+// It has to run in a later transaction than the one the keys were deleted in:
+// until a transaction commits, pages emptied by deletes are still in the tree
+// and a cursor stops at them, so buckets look empty when they aren't.
+func deleteEmptyBuckets(tx *bolt.Tx, index string) error {
+	indexBucket := tx.Bucket([]byte(index))
+	if indexBucket == nil {
+		return nil
+	}
+
+	var empty [][]byte
+	err := indexBucket.ForEach(func(name, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		if k, _ := indexBucket.Bucket(name).Cursor().First(); k == nil {
+			empty = append(empty, append([]byte{}, name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range empty {
+		if err := indexBucket.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneAlerts deletes alerts last seen before cutoff, and their entries in
+// alert_routes.
+func pruneAlerts(tx *bolt.Tx, cutoff int64) (count int, err error) {
+	alertsBucket := tx.Bucket([]byte(ALERTS_BUCKET_NAME))
+	if alertsBucket == nil {
+		return 0, nil
+	}
+
+	old := map[string][]string{}
+	err = alertsBucket.ForEach(func(k, v []byte) error {
+		var alert gtfsrt.ArchivedAlert
+		if err := proto.Unmarshal(v, &alert); err != nil {
+			return err
+		}
+		if alert.GetLastSeen() < cutoff {
+			old[string(k)] = AlertRoutes(alert.GetAlert())
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for id, routes := range old {
+		for _, route := range routes {
+			if err = deleteIndexEntry(tx, ALERT_ROUTES_BUCKET_NAME, []byte(route), []byte(id)); err != nil {
+				return
+			}
+		}
+		if err = alertsBucket.Delete([]byte(id)); err != nil {
+			return
+		}
+	}
+	return len(old), nil
+}
+
+// pruneRawFeeds deletes raw feeds from before cutoff, which sort first since
+// they're keyed by time.
+func pruneRawFeeds(tx *bolt.Tx, cutoff int64) (count int, err error) {
+	for _, kind := range []string{RAW_VEHICLE_POSITIONS, RAW_TRIP_UPDATES, RAW_ALERTS} {
+		kindBucket := rawFeedsBucket(tx, kind)
+		if kindBucket == nil {
+			continue
+		}
+
+		var keys [][]byte
+		c := kindBucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, TimeKey(cutoff)) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err = kindBucket.Delete(k); err != nil {
+				return
+			}
+		}
+		count += len(keys)
+	}
+	return
+}
+
+// compactor copies buckets into a new database, committing every
+// COMPACT_TX_SIZE bytes.
+type compactor struct {
+	db   *bolt.DB
+	tx   *bolt.Tx
+	size int
+}
+
+// bucket returns the bucket at path in the current transaction, creating it
+// and its parents if necessary.
+func (c *compactor) bucket(path [][]byte) (b *bolt.Bucket, err error) {
+	b, err = c.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	return
+}
+
+func (c *compactor) put(path [][]byte, k, v []byte) error {
+	if c.size+len(k)+len(v) > COMPACT_TX_SIZE {
+		if err := c.tx.Commit(); err != nil {
+			return err
+		}
+		tx, err := c.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		c.tx, c.size = tx, 0
+	}
+
+	b, err := c.bucket(path)
+	if err != nil {
+		return err
+	}
+	c.size += len(k) + len(v)
+	return b.Put(k, v)
+}
+
+func (c *compactor) copyBucket(path [][]byte, src *bolt.Bucket) error {
+	// empty buckets are copied too
+	if _, err := c.bucket(path); err != nil {
+		return err
+	}
+
+	cursor := src.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var err error
+		if v == nil {
+			child := append(append([][]byte{}, path...), k)
+			err = c.copyBucket(child, src.Bucket(k))
+		} else {
+			err = c.put(path, k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catchUpBucket copies the keys of src which are missing from the bucket at
+// path, or hold a different value, and does the same for its nested buckets.
+func (c *compactor) catchUpBucket(path [][]byte, src *bolt.Bucket) (count int, err error) {
+	dst := c.lookup(path)
+	cursor := src.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if v == nil {
+			child := append(append([][]byte{}, path...), k)
+			n, err := c.catchUpBucket(child, src.Bucket(k))
+			count += n
+			if err != nil {
+				return count, err
+			}
+			dst = c.lookup(path)
+			continue
+		}
+		if dst != nil {
+			if existing := dst.Get(k); existing != nil && bytes.Equal(existing, v) {
+				continue
+			}
+		}
+		if err = c.put(path, k, v); err != nil {
+			return
+		}
+		count++
+		// put may have started a new transaction
+		dst = c.lookup(path)
+	}
+	return
+}
+
+// lookup returns the bucket at path in the current transaction, or nil if it
+// doesn't exist.
+func (c *compactor) lookup(path [][]byte) *bolt.Bucket {
+	b := c.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// CatchUp copies what was written to src after it was compacted into dst with
+// Compact, returning the number of keys copied. It only copies keys which are
+// new or were overwritten, so src mustn't have had anything deleted from it in
+// the meantime, which holds for the daemon's captures. It reads all of src,
+// but only writes what changed.
+func CatchUp(src, dst *bolt.DB) (count int, err error) {
+	c := &compactor{db: dst}
+	if c.tx, err = dst.Begin(true); err != nil {
+		return
+	}
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			n, err := c.catchUpBucket([][]byte{name}, b)
+			count += n
+			return err
+		})
+	})
+	if err != nil {
+		c.tx.Rollback()
+		return
+	}
+	err = c.tx.Commit()
+	return
+}
+
+// Compact copies every bucket of src into a new database at dstPath, which
+// only takes as much space as the data needs. src can be written to while it's
+// copied, but writes committed after Compact starts aren't copied.
+func Compact(src *bolt.DB, dstPath string) error {
+	return compactExcept(src, dstPath, nil)
+}
+
+// compactExcept compacts src into a new database at dstPath like Compact,
+// leaving out the top-level buckets named in skip.
+func compactExcept(src *bolt.DB, dstPath string, skip map[string]bool) (err error) {
+	if _, err = os.Stat(dstPath); err == nil {
+		return fmt.Errorf("%s already exists", dstPath)
+	}
+
+	dst, err := bolt.Open(dstPath, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		return
+	}
+	// the copy is only used once it's complete, so it's synced once at the end
+	dst.NoSync = true
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+	}()
+
+	c := &compactor{db: dst}
+	if c.tx, err = dst.Begin(true); err != nil {
+		return
+	}
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if skip[string(name)] {
+				return nil
+			}
+			return c.copyBucket([][]byte{name}, b)
+		})
+	})
+	if err != nil {
+		c.tx.Rollback()
+		return
+	}
+	if err = c.tx.Commit(); err != nil {
+		return
+	}
+	return dst.Sync()
+}
+
+// CompactFile compacts the database at path in place, by compacting it into a
+// new file which replaces it. db must be the open database at path, which is
+// closed. It returns the size of the file before and after.
+func CompactFile(db *bolt.DB, path string) (before, after int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	before = info.Size()
+
+	// a copy left by a compaction which was interrupted is incomplete
+	tmpPath := path + ".compact"
+	if err = os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		db.Close()
+		return
+	}
+	if err = Compact(db, tmpPath); err != nil {
+		db.Close()
+		return
+	}
+	if err = db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	if info, err = os.Stat(path); err != nil {
+		return
+	}
+	return before, info.Size(), nil
+}
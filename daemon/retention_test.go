@@ -0,0 +1,418 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// an hour which starts a bucket of the time index
+const pruneBase = 1449813600
+
+func alert(id string, lastSeen int64, routes ...string) *gtfsrt.ArchivedAlert {
+	a := &gtfsrt.Alert{}
+	for _, route := range routes {
+		a.InformedEntity = append(a.InformedEntity, &gtfsrt.EntitySelector{RouteId: proto.String(route)})
+	}
+	return &gtfsrt.ArchivedAlert{Id: proto.String(id), FirstSeen: proto.Int64(pruneBase), LastSeen: proto.Int64(lastSeen), Alert: a}
+}
+
+// pruneDB returns a database holding data from either side of a cutoff of
+// pruneBase+7230.
+func pruneDB(t *testing.T) (*bolt.DB, func()) {
+	db, cleanup := tempDB(t)
+	if err := PrepareDB(db); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	prediction := marshal(t, &gtfsrt.StopTimePrediction{TripId: proto.String("tripA")})
+	err := db.Update(func(tx *bolt.Tx) error {
+		// trip1 keeps its last location, in an hour it shares with a deleted
+		// one, on a route which it also ran on in deleted locations
+		storeLocation(t, tx, "trip1", "v1", "801", pruneBase)
+		storeLocation(t, tx, "trip1", "v1", "801", pruneBase+60)
+		storeLocation(t, tx, "trip1", "v2", "802", pruneBase+3600)
+		storeLocation(t, tx, "trip1", "v1", "801", pruneBase+7210)
+		storeLocation(t, tx, "trip1", "v1", "801", pruneBase+7260)
+		// trip2 is deleted
+		storeLocation(t, tx, "trip2", "v3", "803", pruneBase+100)
+		// trip3 is kept
+		storeLocation(t, tx, "trip3", "v4", "801", pruneBase+8000)
+
+		// tripA's stop1 is deleted and stop2 keeps its last prediction, tripB
+		// is deleted
+		put(t, tx, prediction, TRIP_UPDATES_BUCKET_NAME, "tripA", "stop1", string(TimeKey(pruneBase)))
+		put(t, tx, prediction, TRIP_UPDATES_BUCKET_NAME, "tripA", "stop2", string(TimeKey(pruneBase)))
+		put(t, tx, prediction, TRIP_UPDATES_BUCKET_NAME, "tripA", "stop2", string(TimeKey(pruneBase+8000)))
+		put(t, tx, prediction, TRIP_UPDATES_BUCKET_NAME, "tripB", "stop1", string(TimeKey(pruneBase)))
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	if _, err = storeAlerts(db, []*gtfsrt.ArchivedAlert{alert("a1", pruneBase, "801", "805"), alert("a2", pruneBase+8000, "801")}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	archiveVehiclePosition(t, db, "trip1", "v1", "801", pruneBase, 30.25)
+	archiveVehiclePosition(t, db, "trip3", "v4", "801", pruneBase+8000, 30.25)
+	return db, cleanup
+}
+
+func TestPrune(t *testing.T) {
+	db, cleanup := pruneDB(t)
+	defer cleanup()
+
+	stats, err := Prune(db, pruneBase+7230)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PruneStats{Locations: 5, Trips: 1, Predictions: 3, TripUpdates: 1, Alerts: 1, RawFeeds: 1}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		tripKeys := keys(tx, BUCKET_NAME, "trip1")
+		if len(tripKeys) != 1 || !bytes.Equal(tripKeys[0], LocationKey(pruneBase+7260, "v1")) {
+			t.Errorf("trip1 kept %x, want only its last location", tripKeys)
+		}
+		if got := keys(tx, BUCKET_NAME); len(got) != 2 || string(got[0]) != "trip1" || string(got[1]) != "trip3" {
+			t.Errorf("got trips %q, want trip1 and trip3", got)
+		}
+
+		// the time index keeps the hours of the locations which are left, and
+		// empty hours are deleted
+		wantHours := [][]byte{TimeIndexKey(pruneBase + 7260)}
+		if got := keys(tx, TIME_INDEX_BUCKET_NAME); len(got) != 1 || !bytes.Equal(got[0], wantHours[0]) {
+			t.Errorf("got time index buckets %x, want %x", got, wantHours)
+		}
+		if got := keys(tx, TIME_INDEX_BUCKET_NAME, string(wantHours[0])); len(got) != 2 {
+			t.Errorf("got trips %q in the last hour, want trip1 and trip3", got)
+		}
+
+		if got := keys(tx, ROUTE_INDEX_BUCKET_NAME); len(got) != 1 || string(got[0]) != "801" {
+			t.Errorf("got route index buckets %q, want only 801", got)
+		}
+		if got := keys(tx, ROUTE_INDEX_BUCKET_NAME, "801"); len(got) != 2 {
+			t.Errorf("got trips %q on route 801, want trip1 and trip3", got)
+		}
+
+		if got := keys(tx, VEHICLE_INDEX_BUCKET_NAME); len(got) != 2 || string(got[0]) != "v1" || string(got[1]) != "v4" {
+			t.Errorf("got vehicle index buckets %q, want v1 and v4", got)
+		}
+		if got := keys(tx, VEHICLE_INDEX_BUCKET_NAME, "v1"); len(got) != 1 || !bytes.Equal(got[0], VehicleIndexKey(LocationKey(pruneBase+7260, "v1"), []byte("trip1"))) {
+			t.Errorf("got vehicle index entries %x for v1", got)
+		}
+
+		if got := keys(tx, TRIP_UPDATES_BUCKET_NAME); len(got) != 1 || string(got[0]) != "tripA" {
+			t.Errorf("got trip updates for %q, want only tripA", got)
+		}
+		if got := keys(tx, TRIP_UPDATES_BUCKET_NAME, "tripA"); len(got) != 1 || string(got[0]) != "stop2" {
+			t.Errorf("got tripA stops %q, want only stop2", got)
+		}
+		if got := keys(tx, TRIP_UPDATES_BUCKET_NAME, "tripA", "stop2"); len(got) != 1 || !bytes.Equal(got[0], TimeKey(pruneBase+8000)) {
+			t.Errorf("got stop2 predictions %x, want only the last", got)
+		}
+
+		if got := keys(tx, ALERTS_BUCKET_NAME); len(got) != 1 || string(got[0]) != "a2" {
+			t.Errorf("got alerts %q, want a2", got)
+		}
+		if got := keys(tx, ALERT_ROUTES_BUCKET_NAME); len(got) != 1 || string(got[0]) != "801" {
+			t.Errorf("got alert routes %q, want 801", got)
+		}
+		if got := keys(tx, ALERT_ROUTES_BUCKET_NAME, "801"); len(got) != 1 || string(got[0]) != "a2" {
+			t.Errorf("got alerts %q on route 801, want a2", got)
+		}
+
+		if got := keys(tx, RAW_FEEDS_BUCKET_NAME, RAW_VEHICLE_POSITIONS); len(got) != 1 || KeyTime(got[0]) != pruneBase+8000 {
+			t.Errorf("got raw feeds %x, want the last", got)
+		}
+		return nil
+	})
+
+	if pruned, err := LastPruned(db); err != nil || time.Since(pruned) > time.Minute {
+		t.Errorf("got last pruned %s, %v, want now", pruned, err)
+	}
+
+	// pruning again deletes nothing
+	if stats, err = Prune(db, pruneBase+7230); err != nil || stats != (PruneStats{}) {
+		t.Errorf("pruning twice: got %+v, %v", stats, err)
+	}
+}
+
+func TestDeleteEmptyBuckets(t *testing.T) {
+	db, cleanup := tempDB(t)
+	defer cleanup()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		put(t, tx, []byte{}, ROUTE_INDEX_BUCKET_NAME, "801", "trip1")
+		put(t, tx, []byte{}, ROUTE_INDEX_BUCKET_NAME, "802", "trip2")
+		put(t, tx, []byte{}, ROUTE_INDEX_BUCKET_NAME, "803", "trip3")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := deleteIndexEntry(tx, ROUTE_INDEX_BUCKET_NAME, []byte("801"), []byte("trip1")); err != nil {
+			return err
+		}
+		return deleteIndexEntry(tx, ROUTE_INDEX_BUCKET_NAME, []byte("803"), []byte("trip3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := deleteEmptyBuckets(tx, ROUTE_INDEX_BUCKET_NAME); err != nil {
+			return err
+		}
+		// an index which doesn't exist is left alone
+		return deleteEmptyBuckets(tx, VEHICLE_INDEX_BUCKET_NAME)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if got := keys(tx, ROUTE_INDEX_BUCKET_NAME); len(got) != 1 || string(got[0]) != "802" {
+			t.Errorf("got route index buckets %q, want only 802", got)
+		}
+		return nil
+	})
+}
+
+// contents returns every key and value in a database, by path.
+func contents(t *testing.T, db *bolt.DB) map[string]string {
+	all := map[string]string{}
+	var walk func(path string, b *bolt.Bucket)
+	walk = func(path string, b *bolt.Bucket) {
+		b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				walk(fmt.Sprintf("%s/%x", path, k), b.Bucket(k))
+			} else {
+				all[fmt.Sprintf("%s/%x", path, k)] = string(v)
+			}
+			return nil
+		})
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			walk(string(name), b)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+func compareContents(t *testing.T, got, want map[string]string) {
+	if len(got) != len(want) {
+		t.Errorf("got %d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	db, cleanup := pruneDB(t)
+	defer cleanup()
+	path := db.Path()
+
+	if _, err := Prune(db, pruneBase+7230); err != nil {
+		t.Fatal(err)
+	}
+	want := contents(t, db)
+
+	// a copy left by an interrupted compaction is thrown away
+	if f, err := os.Create(path + ".compact"); err == nil {
+		f.Close()
+	}
+
+	before, after, err := CompactFile(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != after || after > before {
+		t.Errorf("got sizes %d and %d, file is %v, %v", before, after, info, err)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("copy wasn't moved into place: %v", err)
+	}
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	compareContents(t, contents(t, db), want)
+}
+
+func TestCatchUp(t *testing.T) {
+	src, cleanup := pruneDB(t)
+	defer cleanup()
+	dstPath := src.Path() + ".compact"
+	defer os.Remove(dstPath)
+
+	if err := Compact(src, dstPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// what captures write while a database is compacted: new trips, new
+	// locations of trips already copied, index entries with empty values and
+	// alerts seen again
+	err := src.Update(func(tx *bolt.Tx) error {
+		storeLocation(t, tx, "trip1", "v1", "801", pruneBase+9000)
+		storeLocation(t, tx, "trip4", "v5", "806", pruneBase+9000)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storeAlerts(src, []*gtfsrt.ArchivedAlert{alert("a2", pruneBase+9000, "801")}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := bolt.Open(dstPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	count, err := CatchUp(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 locations, 4 new index entries and an alert
+	if count != 7 {
+		t.Errorf("caught up with %d keys, want 7", count)
+	}
+	compareContents(t, contents(t, dst), contents(t, src))
+
+	if count, err = CatchUp(src, dst); err != nil || count != 0 {
+		t.Errorf("catching up twice: got %d keys, %v", count, err)
+	}
+}
+
+func TestFeedCompact(t *testing.T) {
+	db, cleanup := pruneDB(t)
+	path := db.Path()
+	db.Close()
+	defer cleanup()
+
+	f := newFeed(FeedConfig{Name: "capmetro", DBPath: path})
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	old := f.db
+
+	// enough locations for captures to write while the database is copied
+	err := old.Update(func(tx *bolt.Tx) error {
+		for i := int64(0); i < 20000; i++ {
+			storeLocation(t, tx, fmt.Sprintf("trip%d", 100+i%100), "v7", "808", pruneBase+i)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// captures carry on while the database is compacted
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	written := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			f.mu.Lock()
+			err := f.db.Update(func(tx *bolt.Tx) error {
+				storeLocation(t, tx, "trip5", "v6", "807", pruneBase+10000+int64(written))
+				return nil
+			})
+			f.mu.Unlock()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			written++
+		}
+	}()
+
+	err = f.compact(old)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.db == old {
+		t.Fatal("feed's database wasn't replaced")
+	}
+
+	// every location written during compaction made it, and can be queried
+	// through the archive
+	err = FindArchive("capmetro").View(func(tx *bolt.Tx) error {
+		if got := keys(tx, BUCKET_NAME, "trip5"); len(got) != written {
+			t.Errorf("got %d locations written while compacting, want %d", len(got), written)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.View(func(*bolt.Tx) error { return nil }); err != bolt.ErrDatabaseNotOpen {
+		t.Errorf("old database wasn't closed: %v", err)
+	}
+}
+
+func TestPruneDue(t *testing.T) {
+	db, cleanup := tempDB(t)
+	path := db.Path()
+	db.Close()
+	defer cleanup()
+
+	if newFeed(FeedConfig{Name: "capmetro", DBPath: path}).pruneDue() {
+		t.Error("feed without a retention period is due to be pruned")
+	}
+
+	config := FeedConfig{Name: "capmetro", DBPath: path, Retention: Duration{90 * 24 * time.Hour}}
+	f := newFeed(config)
+	if !f.pruneDue() {
+		t.Error("database which has never been pruned isn't due")
+	}
+	if _, err := Prune(f.db, pruneBase); err != nil {
+		t.Fatal(err)
+	}
+	f.close()
+
+	// when it was last pruned is read from the database
+	f = newFeed(config)
+	defer f.close()
+	if f.pruneDue() {
+		t.Error("database which was just pruned is due")
+	}
+	f.lastPrune = time.Now().Add(-PRUNE_INTERVAL)
+	if !f.pruneDue() {
+		t.Errorf("database pruned %s ago isn't due", PRUNE_INTERVAL)
+	}
+}
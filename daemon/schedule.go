@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ADAPTIVE_MIN_INTERVAL and ADAPTIVE_MAX_INTERVAL are the default bounds
+	// of an adaptive schedule.
+	ADAPTIVE_MIN_INTERVAL = 5 * time.Second
+	ADAPTIVE_MAX_INTERVAL = 5 * time.Minute
+	// ADAPTIVE_SPEEDUP scales the interval down each time a feed has been
+	// updated since the last capture, and ADAPTIVE_BACKOFF scales it up each
+	// time it hasn't.
+	ADAPTIVE_SPEEDUP = 0.75
+	ADAPTIVE_BACKOFF = 1.5
+	// STALE_FEED_AGE is how old a feed's header timestamp can get before an
+	// adaptive schedule backs off to its maximum interval.
+	STALE_FEED_AGE = 10 * time.Minute
+)
+
+// captureOutcome is what happened when a feed was captured, which adaptive
+// schedules use to pick the next interval.
+type captureOutcome int
+
+const (
+	captureNone captureOutcome = iota
+	// the capture failed, e.g. the feed couldn't be fetched
+	captureFailed
+	// the feed had been updated since the last capture
+	captureUpdated
+	// the feed had been updated but was empty, e.g. overnight
+	captureIdle
+	// the feed hadn't been updated since the last capture
+	captureUnchanged
+)
+
+func (o captureOutcome) String() string {
+	switch o {
+	case captureFailed:
+		return "failed"
+	case captureUpdated:
+		return "updated"
+	case captureIdle:
+		return "empty"
+	case captureUnchanged:
+		return "unchanged"
+	}
+	return "none"
+}
+
+// schedule picks how long to wait between captures of a feed. A fixed
+// schedule always waits the feed's interval. An adaptive schedule starts at the
+// interval and polls faster while every capture finds the feed updated, so it
+// settles near the rate the producer publishes at, and slower while it finds
+// the feed unchanged or empty, e.g. overnight.
+type schedule struct {
+	adaptive bool
+	interval time.Duration
+	min      time.Duration
+	max      time.Duration
+}
+
+func newSchedule(config FeedConfig) *schedule {
+	return &schedule{
+		adaptive: config.Adaptive,
+		interval: config.Interval.Duration,
+		min:      config.MinInterval.Duration,
+		max:      config.MaxInterval.Duration,
+	}
+}
+
+// next returns the interval until the next capture, given the outcome of the
+// last one and the timestamp of the last feed captured (0 if unknown).
+func (s *schedule) next(outcome captureOutcome, headerTime int64, now time.Time) time.Duration {
+	if !s.adaptive {
+		return s.interval
+	}
+
+	switch {
+	case headerTime > 0 && now.Sub(time.Unix(headerTime, 0)) > STALE_FEED_AGE:
+		s.interval = s.max
+	case outcome == captureUpdated:
+		s.interval = time.Duration(float64(s.interval) * ADAPTIVE_SPEEDUP)
+	case outcome == captureIdle || outcome == captureUnchanged:
+		s.interval = time.Duration(float64(s.interval) * ADAPTIVE_BACKOFF)
+	}
+
+	// round to the millisecond, without Duration.Round which needs Go 1.9
+	s.interval = (s.interval + time.Millisecond/2) / time.Millisecond * time.Millisecond
+	if s.interval < s.min {
+		s.interval = s.min
+	}
+	if s.interval > s.max {
+		s.interval = s.max
+	}
+	return s.interval
+}
+
+func (s *schedule) String() string {
+	if !s.adaptive {
+		return fmt.Sprintf("every %s", s.interval)
+	}
+	return fmt.Sprintf("adaptive from %s, between %s and %s", s.interval, s.min, s.max)
+}
@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"os"
+	"time"
+)
+
+const (
+	STORE_ATTEMPTS = 3
+	STORE_BACKOFF  = 500 * time.Millisecond
+)
+
+// permanentErrors are errors storing a single record which retrying won't fix.
+var permanentErrors = map[error]bool{
+	bolt.ErrBucketNameRequired: true,
+	bolt.ErrKeyRequired:        true,
+	bolt.ErrKeyTooLarge:        true,
+	bolt.ErrValueTooLarge:      true,
+	bolt.ErrIncompatibleValue:  true,
+}
+
+// updateWithRetry runs fn in a read-write transaction, retrying with
+// exponential backoff unless it fails with a permanent error.
+func updateWithRetry(db *bolt.DB, fn func(*bolt.Tx) error) (err error) {
+	backoff := STORE_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err = db.Update(fn)
+		if err == nil || permanentErrors[err] || attempt == STORE_ATTEMPTS {
+			return
+		}
+
+		elog.Printf("Error storing data (attempt %d of %d), retrying in %s: %s\n", attempt, STORE_ATTEMPTS, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// failedLocation is a location which couldn't be stored.
+type failedLocation struct {
+	location *gtfsrt.VehicleLocation
+	err      error
+}
+
+type deadLetter struct {
+	FailedAt string                  `json:"failed_at"`
+	Error    string                  `json:"error"`
+	Location *gtfsrt.VehicleLocation `json:"location"`
+}
+
+// writeDeadLetters appends locations which couldn't be stored to a file of
+// JSON records, one per line, so they aren't lost.
+func writeDeadLetters(path string, failed []failedLocation) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now().Format(ISO8601_FORMAT)
+	enc := json.NewEncoder(f)
+	for _, failure := range failed {
+		letter := deadLetter{
+			FailedAt: now,
+			Error:    failure.err.Error(),
+			Location: failure.location,
+		}
+		if err = enc.Encode(letter); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
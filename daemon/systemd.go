@@ -0,0 +1,156 @@
+package daemon
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemdNotifier tells systemd about the daemon's state over the socket in
+// NOTIFY_SOCKET, which systemd sets for services with Type=notify. The daemon
+// is reported ready after the first successful capture of any feed, and the
+// watchdog is pinged after every capture, whatever its outcome, so systemd
+// only steps in if captures stop being attempted. Without NOTIFY_SOCKET it
+// does nothing.
+type systemdNotifier struct {
+	mu     sync.Mutex
+	socket string
+	ready  bool
+	// reloadingConfig holds off reporting the daemon ready while the feeds
+	// are being restarted with a new config.
+	reloadingConfig bool
+	// watchdog is how often systemd expects the watchdog to be pinged, from
+	// WATCHDOG_USEC, or 0 if it isn't enabled.
+	watchdog time.Duration
+}
+
+func newSystemdNotifier() *systemdNotifier {
+	n := &systemdNotifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// send sends newline separated assignments like "READY=1" to systemd.
+func (n *systemdNotifier) send(states ...string) error {
+	if n == nil || n.socket == "" {
+		return nil
+	}
+
+	// sockets in the abstract namespace are given with a leading @
+	name := n.socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+// Notify reports the outcome of a capture as the daemon's status and pings
+// the watchdog, marking the daemon ready after its first successful capture.
+func (n *systemdNotifier) Notify(event *CaptureEvent) error {
+	if n == nil || n.socket == "" || event.Event == NOTIFY_START {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// systemd shows the status on a single line
+	states := []string{"STATUS=" + strings.Replace(event.String(), "\n", " ", -1), "WATCHDOG=1"}
+	becomesReady := event.Event == NOTIFY_SUCCESS && !n.ready && !n.reloadingConfig
+	if becomesReady {
+		states = append(states, "READY=1")
+	}
+	if err := n.send(states...); err != nil {
+		return err
+	}
+
+	if becomesReady {
+		n.ready = true
+		log.Println("Notified systemd that the daemon is ready")
+	}
+	return nil
+}
+
+// reloading tells systemd the config is being reloaded, before the old feeds
+// are stopped. The daemon isn't reported ready again until reloaded is called
+// and a feed has then been captured.
+func (n *systemdNotifier) reloading() {
+	if n == nil || n.socket == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.send("RELOADING=1", "STATUS=Reloading config"); err != nil {
+		elog.Printf("Error notifying systemd: %s\n", err)
+	}
+	n.ready = false
+	n.reloadingConfig = true
+}
+
+// reloaded lets the next successful capture report the daemon ready, once the
+// feeds have been started with the new config.
+func (n *systemdNotifier) reloaded() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.reloadingConfig = false
+}
+
+// busy sets the daemon's status while it's doing something besides capturing
+// which can take longer than the watchdog allows, like compacting a database,
+// and pings the watchdog until the returned func is called.
+func (n *systemdNotifier) busy(status string) (done func()) {
+	if n == nil || n.socket == "" {
+		return func() {}
+	}
+
+	ping := func(states ...string) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if err := n.send(states...); err != nil {
+			elog.Printf("Error notifying systemd: %s\n", err)
+		}
+	}
+	ping("STATUS="+status, "WATCHDOG=1")
+	if n.watchdog == 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(n.watchdog / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ping("WATCHDOG=1")
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// stopping tells systemd the daemon is shutting down.
+func (n *systemdNotifier) stopping() {
+	if err := n.send("STOPPING=1", "STATUS=Waiting for captures in progress to finish"); err != nil {
+		elog.Printf("Error notifying systemd: %s\n", err)
+	}
+}
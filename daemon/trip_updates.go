@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"time"
+)
+
+// Stop buckets are named by one of these prefixes, so stop sequences and stop
+// IDs which look like numbers can't collide.
+const (
+	STOP_SEQUENCE_PREFIX = "seq:"
+	STOP_ID_PREFIX       = "id:"
+)
+
+type predictionBins map[string][]*gtfsrt.StopTimePrediction
+
+func CaptureTripUpdates(fetcher *Fetcher, url string, db *bolt.DB, archiveRaw bool) (err error) {
+	pb, err := fetcher.Get(RAW_TRIP_UPDATES, url)
+	if err != nil {
+		return
+	}
+
+	if archiveRaw {
+		if err := ArchiveRawFeed(db, RAW_TRIP_UPDATES, pb); err != nil {
+			elog.Println(err)
+		}
+	}
+
+	predictions, err := decodeTripUpdates(pb)
+	if err != nil {
+		return &decodeError{RAW_TRIP_UPDATES, err}
+	}
+
+	tripBins := binPredictions(predictions)
+
+	if err = storePredictions(db, tripBins); err != nil {
+		return
+	}
+
+	dlog.Printf("Stop time predictions: %d\n", len(predictions))
+	dlog.Printf("Trips with predictions: %d\n", len(tripBins))
+
+	fetcher.Captured(RAW_TRIP_UPDATES, url)
+	return
+}
+
+func decodeTripUpdates(pb []byte) (predictions []*gtfsrt.StopTimePrediction, err error) {
+	start := time.Now()
+	fm := new(gtfsrt.FeedMessage)
+	if err = proto.Unmarshal(pb, fm); err != nil {
+		return nil, err
+	}
+
+	feedTime := int64(fm.GetHeader().GetTimestamp())
+
+	for _, entity := range fm.GetEntity() {
+		update := entity.GetTripUpdate()
+		if update == nil {
+			continue
+		}
+		trip := update.GetTrip()
+
+		// fall back to the feed header when the producer doesn't timestamp each update
+		ts := int64(update.GetTimestamp())
+		if ts == 0 {
+			ts = feedTime
+		}
+
+		for _, stu := range update.GetStopTimeUpdate() {
+			arrival := stu.GetArrival()
+			departure := stu.GetDeparture()
+
+			prediction := &gtfsrt.StopTimePrediction{
+				TripId:               proto.String(trip.GetTripId()),
+				RouteId:              proto.String(trip.GetRouteId()),
+				VehicleId:            proto.String(update.GetVehicle().GetId()),
+				Timestamp:            proto.Int64(ts),
+				StopSequence:         stu.StopSequence,
+				StopId:               stu.StopId,
+				ScheduleRelationship: proto.String(stu.GetScheduleRelationship().String()),
+			}
+			if arrival != nil {
+				prediction.ArrivalDelay = arrival.Delay
+				prediction.ArrivalTime = arrival.Time
+				prediction.ArrivalUncertainty = arrival.Uncertainty
+			}
+			if departure != nil {
+				prediction.DepartureDelay = departure.Delay
+				prediction.DepartureTime = departure.Time
+				prediction.DepartureUncertainty = departure.Uncertainty
+			}
+
+			predictions = append(predictions, prediction)
+		}
+	}
+
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed decoding TripUpdates PB file: %.0fms\n", end.Seconds()*1000)
+
+	return predictions, nil
+}
+
+func binPredictions(predictions []*gtfsrt.StopTimePrediction) predictionBins {
+	bins := predictionBins{}
+
+	for _, prediction := range predictions {
+		trip := prediction.GetTripId()
+		if trip == "" || len(stopKey(prediction)) == 0 {
+			continue
+		}
+		bins[trip] = append(bins[trip], prediction)
+	}
+
+	return bins
+}
+
+// stopKey returns the key of the bucket holding predictions for a single stop
+// of a trip, or nil if the prediction doesn't say which stop it's for. Stop
+// sequence is preferred since a stop may be visited more than once in a trip,
+// encoded as a big-endian uint32 so stops sort in sequence. stop_id is used
+// for feeds which omit it.
+func stopKey(prediction *gtfsrt.StopTimePrediction) []byte {
+	if prediction.StopSequence != nil {
+		key := make([]byte, len(STOP_SEQUENCE_PREFIX)+4)
+		copy(key, STOP_SEQUENCE_PREFIX)
+		binary.BigEndian.PutUint32(key[len(STOP_SEQUENCE_PREFIX):], prediction.GetStopSequence())
+		return key
+	}
+	if prediction.GetStopId() == "" {
+		return nil
+	}
+	return append([]byte(STOP_ID_PREFIX), prediction.GetStopId()...)
+}
+
+func storePredictions(db *bolt.DB, tripBins predictionBins) error {
+	start := time.Now()
+	err := updateWithRetry(db, func(tx *bolt.Tx) error {
+		for trip, predictions := range tripBins {
+			tripBytes := []byte(trip)
+			for _, prediction := range predictions {
+				if err := storeSinglePrediction(tripBytes, prediction, tx); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	end := time.Now().Sub(start)
+	dlog.Printf("Time elapsed saving stop time predictions to BoltDB:  %.0fms\n", end.Seconds()*1000)
+	return nil
+}
+
+func storeSinglePrediction(tripID []byte, prediction *gtfsrt.StopTimePrediction, tx *bolt.Tx) (err error) {
+	topBucket, err := tx.CreateBucketIfNotExists([]byte(TRIP_UPDATES_BUCKET_NAME))
+	if err != nil {
+		return
+	}
+	tripBucket, err := topBucket.CreateBucketIfNotExists(tripID)
+	if err != nil {
+		return
+	}
+	stopBucket, err := tripBucket.CreateBucketIfNotExists(stopKey(prediction))
+	if err != nil {
+		return
+	}
+
+	data, err := proto.Marshal(prediction)
+	if err != nil {
+		return
+	}
+
+	// key is POSIX time of the update
+	return stopBucket.Put(TimeKey(prediction.GetTimestamp()), data)
+}
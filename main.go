@@ -2,23 +2,140 @@ package main
 
 import (
 	"fmt"
-    "github.com/urfave/cli"
+	"github.com/scascketta/capmetricsd/api"
 	"github.com/scascketta/capmetricsd/daemon"
 	"github.com/scascketta/capmetricsd/tools"
+	"github.com/urfave/cli"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
-	DB_ENV      = "CAPMETRICSDB"
-	GET_USAGE   = "USAGE: capmetricsd get db dest min max"
-	START_USAGE = "USAGE: capmetricsd start -t target-url --db db-path [--cronitor cronitor-url]"
+	DB_ENV                 = "CAPMETRICSDB"
+	GET_USAGE              = "USAGE: capmetricsd get ([--from time] [--to time] | --date date | --last period) [--tz zone] [--service-day-start HH:MM] [--route route] [--trip trip] [--vehicle vehicle] [--bbox minLon,minLat,maxLon,maxLat] [--format format] [--sort trip|time|vehicle] [--compress gzip|none] db dest, or capmetricsd get db dest min max"
+	GET_TRIP_UPDATES_USAGE = "USAGE: capmetricsd get-trip-updates db dest min max"
+	GET_ALERTS_USAGE       = "USAGE: capmetricsd get-alerts [--route route-id] db dest min max"
+	REINDEX_USAGE          = "USAGE: capmetricsd reindex db"
+	MIGRATE_USAGE          = "USAGE: capmetricsd migrate db"
+	REPROCESS_USAGE        = "USAGE: capmetricsd reprocess [--replace] db"
+	PRUNE_USAGE            = "USAGE: capmetricsd prune --older-than period [--no-compact] db"
+	START_USAGE            = "USAGE: capmetricsd start [--http-addr addr] (--config config-path | -t target-url --db db-path [--trip-updates-url trip-updates-url] [--alerts-url alerts-url] [--interval duration | --adaptive [--min-interval duration] [--max-interval duration]] [--fsync policy] [--dead-letter-path path] [--archive-raw] [--retention period] [--timeout duration] [--attempts n] [--header 'Name: value'] [--query-param name=value] [--proxy proxy-url] [--tls-cert cert-path --tls-key key-path] [--tls-ca ca-path] [--cronitor cronitor-url] [--notify type:target] [--fail-after n])"
 )
 
 var (
 	elog = log.New(os.Stderr, "[ERR] ", log.LstdFlags|log.Lshortfile)
 )
 
+// startConfig reads the feeds to capture from a config file, or builds a
+// single feed from command line flags. A nil config means neither was given.
+func startConfig(ctx *cli.Context) (*daemon.Config, error) {
+	if path := ctx.String("config"); path != "" {
+		config, err := daemon.LoadConfig(path)
+		if err == nil && ctx.String("http-addr") != "" {
+			config.HTTPAddr = ctx.String("http-addr")
+		}
+		return config, err
+	}
+
+	target := ctx.String("target-url")
+	db := ctx.String("db-path")
+
+	if target == "" || db == "" {
+		return nil, nil
+	}
+
+	headers, err := parsePairs(ctx.StringSlice("header"), ":")
+	if err != nil {
+		return nil, fmt.Errorf("invalid --header: %s", err)
+	}
+	params, err := parsePairs(ctx.StringSlice("query-param"), "=")
+	if err != nil {
+		return nil, fmt.Errorf("invalid --query-param: %s", err)
+	}
+	notifiers, err := parseNotifiers(ctx.StringSlice("notify"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --notify: %s", err)
+	}
+	var retention time.Duration
+	if value := ctx.String("retention"); value != "" {
+		if retention, err = daemon.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid --retention: %s", err)
+		}
+	}
+
+	feed := daemon.FeedConfig{
+		Name:                "default",
+		VehiclePositionsURL: target,
+		TripUpdatesURL:      ctx.String("trip-updates-url"),
+		AlertsURL:           ctx.String("alerts-url"),
+		DBPath:              db,
+		Interval:            daemon.Duration{Duration: ctx.Duration("interval")},
+		Adaptive:            ctx.Bool("adaptive"),
+		MinInterval:         daemon.Duration{Duration: ctx.Duration("min-interval")},
+		MaxInterval:         daemon.Duration{Duration: ctx.Duration("max-interval")},
+		Fsync:               ctx.String("fsync"),
+		DeadLetterPath:      ctx.String("dead-letter-path"),
+		ArchiveRaw:          ctx.Bool("archive-raw"),
+		Retention:           daemon.Duration{Duration: retention},
+		CronitorURL:         ctx.String("cronitor-url"),
+		Notifiers:           notifiers,
+		FailAfter:           ctx.Int("fail-after"),
+		FetcherConfig: daemon.FetcherConfig{
+			Timeout:     daemon.Duration{Duration: ctx.Duration("timeout")},
+			Attempts:    ctx.Int("attempts"),
+			Headers:     headers,
+			QueryParams: params,
+			ProxyURL:    ctx.String("proxy"),
+			TLSCert:     ctx.String("tls-cert"),
+			TLSKey:      ctx.String("tls-key"),
+			TLSCA:       ctx.String("tls-ca"),
+		},
+	}
+	config := &daemon.Config{
+		Feeds:    []daemon.FeedConfig{feed},
+		HTTPAddr: ctx.String("http-addr"),
+	}
+	return config, nil
+}
+
+// parsePairs parses values like "name: value" or "name=value", split on sep,
+// into a map.
+func parsePairs(values []string, sep string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, sep, 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("expected name%svalue, got %q", sep, v)
+		}
+		pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return pairs, nil
+}
+
+// parseNotifiers parses values like "webhook:https://example.com/hook" or
+// "file:/run/capmetricsd/status.json" into notifier configs, with the target
+// taken as a path for file and unix notifiers and a URL for the rest.
+func parseNotifiers(values []string) ([]daemon.NotifierConfig, error) {
+	var configs []daemon.NotifierConfig
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("expected type:target, got %q", v)
+		}
+		config := daemon.NotifierConfig{Type: parts[0]}
+		if config.Type == daemon.NOTIFIER_FILE || config.Type == daemon.NOTIFIER_UNIX {
+			config.Path = parts[1]
+		} else {
+			config.URL = parts[1]
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
 func main() {
 	app := cli.NewApp()
 
@@ -30,6 +147,14 @@ func main() {
 			Name:  "start",
 			Usage: "start the capmetrics daemon (in the foreground)",
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Path to a JSON or YAML (.yaml, .yml) config file describing one or more feeds to capture",
+				},
+				cli.StringFlag{
+					Name:  "http-addr",
+					Usage: "(OPTIONAL) Address to serve the HTTP query API and metrics on, e.g. :8080",
+				},
 				cli.StringFlag{
 					Name:  "target-url, t",
 					Usage: "URL to a GTFS-realtime Vehicle Positions feed",
@@ -38,32 +163,236 @@ func main() {
 					Name:  "db-path, db",
 					Usage: "Path to a BoltDB database.",
 				},
+				cli.StringFlag{
+					Name:  "trip-updates-url, tu",
+					Usage: "(OPTIONAL) URL to a GTFS-realtime Trip Updates feed",
+				},
+				cli.StringFlag{
+					Name:  "alerts-url, al",
+					Usage: "(OPTIONAL) URL to a GTFS-realtime Alerts feed",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "(OPTIONAL) How often to capture the feeds, or where an adaptive schedule starts (default: 30s)",
+				},
+				cli.BoolFlag{
+					Name:  "adaptive",
+					Usage: "(OPTIONAL) Capture faster while the feed is updated every time, and slower while it's unchanged or empty",
+				},
+				cli.DurationFlag{
+					Name:  "min-interval",
+					Usage: "(OPTIONAL) Shortest interval of an adaptive schedule (default: 5s)",
+				},
+				cli.DurationFlag{
+					Name:  "max-interval",
+					Usage: "(OPTIONAL) Longest interval of an adaptive schedule (default: 5m)",
+				},
+				cli.StringFlag{
+					Name:  "fsync",
+					Value: "always",
+					Usage: "When to fsync BoltDB writes: always, never, or at most once per interval (e.g. 5m)",
+				},
+				cli.StringFlag{
+					Name:  "dead-letter-path",
+					Usage: "(OPTIONAL) File to append locations which couldn't be stored to (default: db-path.deadletter.jsonl)",
+				},
+				cli.BoolFlag{
+					Name:  "archive-raw",
+					Usage: "(OPTIONAL) Store every fetched feed as-is, so locations can be rebuilt with reprocess",
+				},
+				cli.StringFlag{
+					Name:  "retention",
+					Usage: "(OPTIONAL) Prune data older than this once a day, e.g. 90d (default: keep everything)",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "(OPTIONAL) How long each request for a feed can take (default: 30s)",
+				},
+				cli.IntFlag{
+					Name:  "attempts",
+					Usage: "(OPTIONAL) How many times to request a feed before giving up on network errors or 5xx responses (default: 3)",
+				},
+				cli.StringSliceFlag{
+					Name:  "header",
+					Usage: "(OPTIONAL) Header to send with every request, like 'X-Api-Key: secret', may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "query-param",
+					Usage: "(OPTIONAL) Query parameter to add to every request, like api_key=secret, may be repeated",
+				},
+				cli.StringFlag{
+					Name:  "proxy",
+					Usage: "(OPTIONAL) URL of a proxy to send requests through (default: from HTTP_PROXY and HTTPS_PROXY)",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "(OPTIONAL) Path to a PEM client certificate, for feeds which require mutual TLS",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "(OPTIONAL) Path to the PEM key of --tls-cert",
+				},
+				cli.StringFlag{
+					Name:  "tls-ca",
+					Usage: "(OPTIONAL) Path to PEM CA certificates to verify feeds with, instead of the system's",
+				},
 				cli.StringFlag{
 					Name:  "cronitor-url, cron",
 					Usage: "(OPTIONAL) URL to send requests to notify Cronitor (or comparable monitoring service)",
 				},
+				cli.StringSliceFlag{
+					Name:  "notify",
+					Usage: "(OPTIONAL) Notifier to tell about captures, as type:target, e.g. healthchecks:https://hc-ping.com/uuid, webhook:url, file:path or unix:socket-path, can be repeated",
+				},
+				cli.IntFlag{
+					Name:  "fail-after",
+					Usage: "(OPTIONAL) Number of captures which have to fail in a row before notifiers are told (default: 1)",
+				},
 			},
 			Action: func(ctx *cli.Context) {
-				target := ctx.String("target-url")
-				db := ctx.String("db-path")
-
-				if target == "" || db == "" {
+				config, err := startConfig(ctx)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if config == nil {
 					fmt.Println(START_USAGE)
 					return
 				}
 
-				cronitor := ctx.String("cronitor-url")
+				// the API only reads from the daemon's open databases, so it's
+				// unaffected by reloading the feeds
+				var services []io.Closer
+				if config.HTTPAddr != "" {
+					server := api.NewServer(config.HTTPAddr)
+					go func() {
+						if err := server.ListenAndServe(); err != nil {
+							log.Fatal(err)
+						}
+					}()
+					services = append(services, server)
+				}
 
-				log.Printf("Starting capmetrics daemon -- target: %s, dbPath: %s, cronitor URL: %s\n", target, db, cronitor)
-				daemon.Start(target, cronitor, db)
+				log.Printf("Starting capmetrics daemon with %d feed(s)\n", len(config.Feeds))
+				load := func() (*daemon.Config, error) {
+					return startConfig(ctx)
+				}
+				if err = daemon.Start(load, services...); err != nil {
+					log.Fatal(err)
+				}
 			},
 		},
 		{
 			Name:  "get",
-			Usage: "get all data between two POSIX timestamps",
+			Usage: "get all data from min up to (but not including) max, or in a range given by flags",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "start of the range, as a POSIX timestamp or a date like 2016-03-01 or 2016-03-01T15:04",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "end of the range (exclusive), in the same forms as --from",
+				},
+				cli.StringFlag{
+					Name:  "date",
+					Usage: "a single service day, like 2016-03-01",
+				},
+				cli.StringFlag{
+					Name:  "last",
+					Usage: "the period up to now, like 6h or 7d",
+				},
+				cli.StringFlag{
+					Name:  "tz",
+					Usage: "time zone for dates, like America/Chicago (default: local time)",
+				},
+				cli.StringFlag{
+					Name:  "service-day-start",
+					Value: "00:00",
+					Usage: "local time (HH:MM) each day starts at, e.g. 03:00 to match an agency's service day",
+				},
+				cli.StringSliceFlag{
+					Name:  "route",
+					Usage: "only get locations on this route, may be repeated and use wildcards like 80*",
+				},
+				cli.StringSliceFlag{
+					Name:  "trip",
+					Usage: "only get locations on this trip, may be repeated and use wildcards",
+				},
+				cli.StringSliceFlag{
+					Name:  "vehicle",
+					Usage: "only get locations of this vehicle, may be repeated and use wildcards",
+				},
+				cli.StringFlag{
+					Name:  "bbox",
+					Usage: "only get locations within minLon,minLat,maxLon,maxLat",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "csv",
+					Usage: "output format: " + strings.Join(tools.LocationFormats(), ", "),
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "order locations by trip, time or vehicle (default: vehicle if --vehicle is given, otherwise trip)",
+				},
+				cli.StringFlag{
+					Name:  "compress",
+					Usage: "compress the output with gzip or none (default: gzip if dest ends with .gz)",
+				},
+			},
+			Action: func(ctx *cli.Context) {
+				r := &tools.TimeRange{
+					From:            ctx.String("from"),
+					To:              ctx.String("to"),
+					Date:            ctx.String("date"),
+					Last:            ctx.String("last"),
+					TZ:              ctx.String("tz"),
+					ServiceDayStart: ctx.String("service-day-start"),
+				}
+
+				q := &tools.LocationQuery{
+					Routes:   ctx.StringSlice("route"),
+					Trips:    ctx.StringSlice("trip"),
+					Vehicles: ctx.StringSlice("vehicle"),
+					Sort:     ctx.String("sort"),
+				}
+				var err error
+				switch {
+				case r.IsSet() && len(ctx.Args()) == 2:
+					q.Min, q.Max, err = r.Resolve(time.Now())
+				case !r.IsSet() && len(ctx.Args()) == 4:
+					q.Min, q.Max, err = tools.ParseTimeRange(ctx.Args()[2], ctx.Args()[3])
+				default:
+					log.Fatal("Missing or extra command arguments\n", GET_USAGE)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+				if bbox := ctx.String("bbox"); bbox != "" {
+					if q.BBox, err = tools.ParseBBox(bbox); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				db := ctx.Args()[0]
+				dest := ctx.Args()[1]
+
+				opts := &tools.ExportOptions{
+					Format:      ctx.String("format"),
+					Compression: ctx.String("compress"),
+				}
+				err = tools.GetData(db, dest, q, opts)
+				if err != nil {
+					elog.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "get-trip-updates",
+			Usage: "get all stop time predictions from min up to (but not including) max",
 			Action: func(ctx *cli.Context) {
 				if len(ctx.Args()) < 4 {
-					log.Fatal("Missing command arguments\n", GET_USAGE)
+					log.Fatal("Missing command arguments\n", GET_TRIP_UPDATES_USAGE)
 				}
 
 				db := ctx.Args()[0]
@@ -71,12 +400,105 @@ func main() {
 				min := ctx.Args()[2]
 				max := ctx.Args()[3]
 
-				err := tools.GetData(db, dest, min, max)
+				err := tools.GetTripUpdates(db, dest, min, max)
 				if err != nil {
 					elog.Println(err)
 				}
 			},
 		},
+		{
+			Name:  "get-alerts",
+			Usage: "get all alerts in effect from min up to (but not including) max",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "route, r",
+					Usage: "(OPTIONAL) only get alerts affecting this route ID",
+				},
+			},
+			Action: func(ctx *cli.Context) {
+				if len(ctx.Args()) < 4 {
+					log.Fatal("Missing command arguments\n", GET_ALERTS_USAGE)
+				}
+
+				db := ctx.Args()[0]
+				dest := ctx.Args()[1]
+				min := ctx.Args()[2]
+				max := ctx.Args()[3]
+
+				err := tools.GetAlerts(db, dest, ctx.String("route"), min, max)
+				if err != nil {
+					elog.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "reindex",
+			Usage: "backfill the indexes of a Bolt database written by an older version",
+			Action: func(ctx *cli.Context) {
+				if len(ctx.Args()) < 1 {
+					log.Fatal("Missing path to Bolt database\n", REINDEX_USAGE)
+				}
+				if err := tools.Reindex(ctx.Args()[0]); err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "rewrite a Bolt database written by an older version to use the current key format",
+			Action: func(ctx *cli.Context) {
+				if len(ctx.Args()) < 1 {
+					log.Fatal("Missing path to Bolt database\n", MIGRATE_USAGE)
+				}
+				if err := tools.Migrate(ctx.Args()[0]); err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "reprocess",
+			Usage: "decode the archived raw feeds in a Bolt database again, storing their locations over those stored",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "(OPTIONAL) Delete every stored location and rebuild them from the raw feeds alone, losing any captured while raw feeds weren't archived",
+				},
+			},
+			Action: func(ctx *cli.Context) {
+				if len(ctx.Args()) < 1 {
+					log.Fatal("Missing path to Bolt database\n", REPROCESS_USAGE)
+				}
+				if err := tools.Reprocess(ctx.Args()[0], ctx.Bool("replace")); err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "delete data older than a period from a Bolt database and compact it",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "older-than",
+					Usage: "Delete trips, trip updates, alerts and raw feeds older than this, e.g. 90d or 2160h",
+				},
+				cli.BoolFlag{
+					Name:  "no-compact",
+					Usage: "(OPTIONAL) Leave the space freed in the file for Bolt to reuse, rather than compacting it",
+				},
+			},
+			Action: func(ctx *cli.Context) {
+				if len(ctx.Args()) < 1 || ctx.String("older-than") == "" {
+					log.Fatal("Missing path to Bolt database or --older-than\n", PRUNE_USAGE)
+				}
+				olderThan, err := daemon.ParseDuration(ctx.String("older-than"))
+				if err != nil || olderThan <= 0 {
+					log.Fatalf("Invalid --older-than: %q\n%s", ctx.String("older-than"), PRUNE_USAGE)
+				}
+				if err := tools.Prune(ctx.Args()[0], olderThan, !ctx.Bool("no-compact")); err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
 		{
 			Name:  "ingest",
 			Usage: "ingest historical CSV data",
@@ -0,0 +1,198 @@
+package tools
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// alertActiveBetween reports whether an alert was in effect at any point in
+// [min, max]. Alerts without an active period are shown for as long as they
+// appear in the feed, so the times they were first and last seen are used.
+func alertActiveBetween(alert *gtfsrt.ArchivedAlert, min, max int64) bool {
+	periods := alert.GetAlert().GetActivePeriod()
+	if len(periods) == 0 {
+		return alert.GetFirstSeen() <= max && alert.GetLastSeen() >= min
+	}
+
+	for _, period := range periods {
+		start, end := int64(math.MinInt64), int64(math.MaxInt64)
+		if period.Start != nil {
+			start = int64(period.GetStart())
+		}
+		if period.End != nil {
+			end = int64(period.GetEnd())
+		}
+		if start <= max && end > min {
+			return true
+		}
+	}
+	return false
+}
+
+func readAlerts(db daemon.Viewer, route string, min, max int64) ([]*gtfsrt.ArchivedAlert, error) {
+	alerts := []*gtfsrt.ArchivedAlert{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		alertsBucket := tx.Bucket([]byte(daemon.ALERTS_BUCKET_NAME))
+		if alertsBucket == nil {
+			return fmt.Errorf("Nonexistent bucket: %s", daemon.ALERTS_BUCKET_NAME)
+		}
+
+		check := func(id, data []byte) error {
+			if data == nil {
+				return fmt.Errorf("Alert %s is indexed but missing", id)
+			}
+			alert := new(gtfsrt.ArchivedAlert)
+			if err := proto.Unmarshal(data, alert); err != nil {
+				return err
+			}
+			if alertActiveBetween(alert, min, max) {
+				alerts = append(alerts, alert)
+			}
+			return nil
+		}
+
+		if route == "" {
+			return alertsBucket.ForEach(check)
+		}
+
+		routesBucket := tx.Bucket([]byte(daemon.ALERT_ROUTES_BUCKET_NAME))
+		if routesBucket == nil {
+			return nil
+		}
+		routeBucket := routesBucket.Bucket([]byte(route))
+		if routeBucket == nil {
+			return nil
+		}
+		return routeBucket.ForEach(func(id, _ []byte) error {
+			return check(id, alertsBucket.Get(id))
+		})
+	})
+
+	return alerts, err
+}
+
+// translation picks the untagged or English text out of a TranslatedString,
+// falling back to whichever translation comes first.
+func translation(s *gtfsrt.TranslatedString) string {
+	translations := s.GetTranslation()
+	for _, t := range translations {
+		lang := strings.ToLower(t.GetLanguage())
+		if lang == "" || lang == "en" || strings.HasPrefix(lang, "en-") {
+			return t.GetText()
+		}
+	}
+	if len(translations) > 0 {
+		return translations[0].GetText()
+	}
+	return ""
+}
+
+func formatActivePeriods(periods []*gtfsrt.TimeRange) string {
+	var formatted []string
+	for _, period := range periods {
+		var start, end string
+		if period.Start != nil {
+			start = time.Unix(int64(period.GetStart()), 0).Local().Format(Iso8601Format)
+		}
+		if period.End != nil {
+			end = time.Unix(int64(period.GetEnd()), 0).Local().Format(Iso8601Format)
+		}
+		formatted = append(formatted, start+"/"+end)
+	}
+	return strings.Join(formatted, " ")
+}
+
+func informedEntities(alert *gtfsrt.Alert) (stops, trips []string) {
+	for _, entity := range alert.GetInformedEntity() {
+		if stop := entity.GetStopId(); stop != "" {
+			stops = append(stops, stop)
+		}
+		if trip := entity.GetTrip().GetTripId(); trip != "" {
+			trips = append(trips, trip)
+		}
+	}
+	return
+}
+
+func writeAlerts(dest string, alerts []*gtfsrt.ArchivedAlert) error {
+	log.Printf("Writing %d alerts to %s.\n", len(alerts), dest)
+
+	headers := []string{
+		"alert_id", "entity_id", "first_seen", "last_seen", "cause", "effect",
+		"active_periods", "route_ids", "trip_ids", "stop_ids", "header", "description", "url",
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err = w.Write(headers); err != nil {
+		log.Println("Error writing CSV header record")
+		return err
+	}
+
+	for _, archived := range alerts {
+		alert := archived.GetAlert()
+		stops, trips := informedEntities(alert)
+		record := []string{
+			archived.GetId(),
+			archived.GetEntityId(),
+			time.Unix(archived.GetFirstSeen(), 0).Local().Format(Iso8601Format),
+			time.Unix(archived.GetLastSeen(), 0).Local().Format(Iso8601Format),
+			alert.GetCause().String(),
+			alert.GetEffect().String(),
+			formatActivePeriods(alert.GetActivePeriod()),
+			strings.Join(daemon.AlertRoutes(alert), " "),
+			strings.Join(trips, " "),
+			strings.Join(stops, " "),
+			translation(alert.GetHeaderText()),
+			translation(alert.GetDescriptionText()),
+			translation(alert.GetUrl()),
+		}
+		if err = w.Write(record); err != nil {
+			log.Println("Error writing CSV records")
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// GetAlerts exports every alert in effect between min and max, optionally
+// limited to those affecting a single route.
+func GetAlerts(dbPath, dest, route string, min, max string) error {
+	log.Printf("Get alerts between %s and %s\n", min, max)
+
+	minTime, maxTime, err := ParseTimeRange(min, max)
+	if err != nil {
+		return err
+	}
+
+	log.Println("dbPath: ", dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	alerts, err := readAlerts(db, route, minTime, maxTime)
+	if err != nil {
+		return err
+	}
+
+	return writeAlerts(dest, alerts)
+}
@@ -0,0 +1,168 @@
+package tools
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strconv"
+	"strings"
+)
+
+// BBox is a bounding box in WGS84 degrees.
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// ParseBBox parses a bounding box given as minLon,minLat,maxLon,maxLat.
+func ParseBBox(s string) (*BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bounding box must be minLon,minLat,maxLon,maxLat, got %q", s)
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinate %q in bounding box", part)
+		}
+		values[i] = v
+	}
+
+	box := &BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	if box.MinLon > box.MaxLon || box.MinLat > box.MaxLat {
+		return nil, fmt.Errorf("bounding box %q has its minimum after its maximum", s)
+	}
+	return box, nil
+}
+
+// contains reports whether a point is within the box. Locations are stored
+// with single precision, so the box is compared at the same precision to
+// include points on its edges.
+func (b *BBox) contains(lon, lat float32) bool {
+	return lon >= float32(b.MinLon) && lon <= float32(b.MaxLon) && lat >= float32(b.MinLat) && lat <= float32(b.MaxLat)
+}
+
+// The parts of a pattern.
+const (
+	globChar = iota
+	globAnyChar
+	globAnyRun
+)
+
+type globToken struct {
+	kind int
+	char rune
+}
+
+// parseGlob splits a pattern of IDs into its parts. * matches any run of
+// characters, including none, and ? matches any single character. \ makes the
+// character after it match only itself, e.g. \* matches a *. Unlike path.Match,
+// / and [ aren't special, since IDs may contain them.
+func parseGlob(pattern string) (tokens []globToken) {
+	chars := []rune(pattern)
+	for i := 0; i < len(chars); i++ {
+		switch c := chars[i]; {
+		case c == '\\' && i+1 < len(chars):
+			i++
+			tokens = append(tokens, globToken{kind: globChar, char: chars[i]})
+		case c == '*':
+			tokens = append(tokens, globToken{kind: globAnyRun})
+		case c == '?':
+			tokens = append(tokens, globToken{kind: globAnyChar})
+		default:
+			tokens = append(tokens, globToken{kind: globChar, char: c})
+		}
+	}
+	return
+}
+
+// globLiteral returns the only value a pattern matches, or false if it has
+// any wildcards.
+func globLiteral(pattern string) (string, bool) {
+	var chars []rune
+	for _, token := range parseGlob(pattern) {
+		if token.kind != globChar {
+			return "", false
+		}
+		chars = append(chars, token.char)
+	}
+	return string(chars), true
+}
+
+// globMatch reports whether value matches the whole of pattern.
+func globMatch(pattern, value string) bool {
+	tokens := parseGlob(pattern)
+	chars := []rune(value)
+
+	// where to resume after the last *, if what follows it doesn't match
+	star, starChar := -1, 0
+	t, c := 0, 0
+	for c < len(chars) {
+		if t < len(tokens) {
+			switch token := tokens[t]; {
+			case token.kind == globAnyRun:
+				star, starChar = t, c
+				t++
+				continue
+			case token.kind == globAnyChar, token.char == chars[c]:
+				t++
+				c++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// the * takes one more character
+		starChar++
+		t, c = star+1, starChar
+	}
+	for t < len(tokens) && tokens[t].kind == globAnyRun {
+		t++
+	}
+	return t == len(tokens)
+}
+
+// matchAny reports whether value matches any of patterns.
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingKeys returns the names of the nested buckets of b matching patterns,
+// without duplicates. Exact names are looked up directly, the keys of b are
+// only scanned if a wildcard is used.
+func matchingKeys(b *bolt.Bucket, patterns []string) [][]byte {
+	if b == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	var names []string
+	for _, pattern := range patterns {
+		name, ok := globLiteral(pattern)
+		if !ok {
+			b.ForEach(func(k, _ []byte) error {
+				if matchAny(patterns, string(k)) {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				return nil
+			})
+			return keys
+		}
+		names = append(names, name)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] && b.Bucket([]byte(name)) != nil {
+			seen[name] = true
+			keys = append(keys, []byte(name))
+		}
+	}
+	return keys
+}
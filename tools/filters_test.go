@@ -0,0 +1,64 @@
+package tools
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"801", "801", true},
+		{"801", "8011", false},
+		{"80*", "801", true},
+		{"80*", "80", true},
+		{"80*", "8", false},
+		{"*1", "801", true},
+		{"8*1", "80011", true},
+		{"8*1*", "8x1y", true},
+		{"*", "", true},
+		{"?", "", false},
+		{"8?1", "801", true},
+		{"8?1", "8001", false},
+		{"??", "é1", true},
+		// IDs with / and [ in them
+		{"MTA NYCT_B63", "MTA NYCT_B63", true},
+		{"trip/1", "trip/1", true},
+		{"trip*", "trip/1/weekday", true},
+		{"*/weekday", "trip/1/weekday", true},
+		{"trip?1", "trip/1", true},
+		{"[801]", "[801]", true},
+		{"[801]", "8", false},
+		{"[80*", "[801]", true},
+		// escapes
+		{`express\*`, "express*", true},
+		{`express\*`, "express1", false},
+		{`what\?`, "what?", true},
+		{`what\?`, "whats", false},
+		{`a\\b`, `a\b`, true},
+		{`a\b`, "ab", true},
+		{`trailing\`, `trailing\`, true},
+	}
+	for _, test := range tests {
+		if match := globMatch(test.pattern, test.value); match != test.match {
+			t.Errorf("globMatch(%q, %q) = %t, want %t", test.pattern, test.value, match, test.match)
+		}
+	}
+}
+
+func TestGlobLiteral(t *testing.T) {
+	tests := []struct {
+		pattern, literal string
+		ok               bool
+	}{
+		{"801", "801", true},
+		{"trip/[1]", "trip/[1]", true},
+		{`express\*`, "express*", true},
+		{"80*", "", false},
+		{"8?1", "", false},
+	}
+	for _, test := range tests {
+		if literal, ok := globLiteral(test.pattern); literal != test.literal || ok != test.ok {
+			t.Errorf("globLiteral(%q) = %q, %t, want %q, %t", test.pattern, literal, ok, test.literal, test.ok)
+		}
+	}
+}
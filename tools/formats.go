@@ -0,0 +1,481 @@
+package tools
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"github.com/scascketta/capmetricsd/tools/parquet"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SnapshotInterval is the period of time covered by each FeedMessage when
+// locations are exported as GTFS-realtime.
+const SnapshotInterval = 30 * time.Second
+
+// LocationWriter writes a stream of locations in some format. Close finishes
+// the output, e.g. by closing a JSON array, but doesn't close the underlying
+// writer.
+type LocationWriter interface {
+	Write(loc *gtfsrt.VehicleLocation) error
+	Close() error
+}
+
+type newLocationWriter func(w io.Writer) (LocationWriter, error)
+
+var locationWriters = map[string]newLocationWriter{
+	"csv":           newCSVWriter,
+	"json":          newJSONWriter,
+	"jsonl":         newJSONLinesWriter,
+	"geojson":       newGeoJSONWriter,
+	"geojson-lines": newGeoJSONLinesWriter,
+	"parquet":       newParquetWriter,
+	"gtfsrt":        newGTFSRealtimeWriter,
+}
+
+// LocationFormats returns the names of the formats locations can be written
+// in.
+func LocationFormats() []string {
+	var formats []string
+	for format := range locationWriters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// IsLocationFormat reports whether locations can be written in format.
+func IsLocationFormat(format string) bool {
+	_, ok := locationWriters[format]
+	return ok
+}
+
+// NewLocationWriter returns a writer of locations to w in one of
+// LocationFormats. Locations are written as they're given, formats which
+// group them expect them in the order set by LocationQuery.SortFor.
+func NewLocationWriter(w io.Writer, format string) (LocationWriter, error) {
+	newWriter, ok := locationWriters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+	return newWriter(w)
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(out io.Writer) (LocationWriter, error) {
+	headers := []string{
+		"vehicle_id", "timestamp", "speed", "route_id", "trip_id", "latitude", "longitude",
+		"bearing", "odometer", "stop_id", "current_stop_sequence", "current_status",
+		"congestion_level", "occupancy_status", "start_date", "start_time", "vehicle_label",
+	}
+
+	w := csv.NewWriter(out)
+	if err := w.Write(headers); err != nil {
+		log.Println("Error writing CSV header record")
+		return nil, err
+	}
+	return &csvWriter{w}, nil
+}
+
+func (cw *csvWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	t := time.Unix(loc.GetTimestamp(), 0).UTC()
+	record := []string{
+		loc.GetVehicleId(),
+		t.Local().Format(Iso8601Format),
+		strconv.FormatFloat(float64(loc.GetSpeed()), 'f', -1, 32),
+		loc.GetRouteId(),
+		loc.GetTripId(),
+		strconv.FormatFloat(float64(loc.GetLatitude()), 'f', -1, 32),
+		strconv.FormatFloat(float64(loc.GetLongitude()), 'f', -1, 32),
+		formatOptionalFloat(loc.Bearing != nil, float64(loc.GetBearing()), 32),
+		formatOptionalFloat(loc.Odometer != nil, loc.GetOdometer(), 64),
+		loc.GetStopId(),
+		formatOptional(loc.CurrentStopSequence != nil, int64(loc.GetCurrentStopSequence())),
+		loc.GetCurrentStatus(),
+		loc.GetCongestionLevel(),
+		loc.GetOccupancyStatus(),
+		loc.GetStartDate(),
+		loc.GetStartTime(),
+		loc.GetVehicleLabel(),
+	}
+	if err := cw.w.Write(record); err != nil {
+		log.Println("Error writing CSV records")
+		return err
+	}
+	return nil
+}
+
+func formatOptionalFloat(isSet bool, v float64, bitSize int) string {
+	if !isSet {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, bitSize)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// arrayWriter writes values as the elements of a JSON array, which may be
+// nested in a larger document.
+type arrayWriter struct {
+	w      io.Writer
+	count  int
+	suffix string
+}
+
+func newArrayWriter(w io.Writer, prefix, suffix string) (*arrayWriter, error) {
+	if _, err := io.WriteString(w, prefix+"["); err != nil {
+		return nil, err
+	}
+	return &arrayWriter{w: w, suffix: "]" + suffix + "\n"}, nil
+}
+
+func (aw *arrayWriter) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if aw.count > 0 {
+		if _, err = io.WriteString(aw.w, ","); err != nil {
+			return err
+		}
+	}
+	aw.count++
+	_, err = aw.w.Write(data)
+	return err
+}
+
+func (aw *arrayWriter) Close() error {
+	_, err := io.WriteString(aw.w, aw.suffix)
+	return err
+}
+
+// jsonWriter writes locations as a JSON array, timestamps are POSIX time.
+type jsonWriter struct {
+	*arrayWriter
+}
+
+func newJSONWriter(w io.Writer) (LocationWriter, error) {
+	aw, err := newArrayWriter(w, "", "")
+	return &jsonWriter{aw}, err
+}
+
+func (jw *jsonWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	return jw.write(loc)
+}
+
+// jsonLinesWriter writes each location as a JSON object on its own line.
+type jsonLinesWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONLinesWriter(w io.Writer) (LocationWriter, error) {
+	return &jsonLinesWriter{json.NewEncoder(w)}, nil
+}
+
+func (jw *jsonLinesWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	return jw.enc.Encode(loc)
+}
+
+func (jw *jsonLinesWriter) Close() error {
+	return nil
+}
+
+type geoJSONFeature struct {
+	Type       string                  `json:"type"`
+	Geometry   geoJSONPoint            `json:"geometry"`
+	Properties *gtfsrt.VehicleLocation `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float32 `json:"coordinates"`
+}
+
+// geoJSONWriter writes locations as a FeatureCollection of points.
+type geoJSONWriter struct {
+	*arrayWriter
+}
+
+func newGeoJSONWriter(w io.Writer) (LocationWriter, error) {
+	aw, err := newArrayWriter(w, `{"type":"FeatureCollection","features":`, "}")
+	return &geoJSONWriter{aw}, err
+}
+
+func (gw *geoJSONWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	return gw.write(geoJSONFeature{
+		Type: "Feature",
+		Geometry: geoJSONPoint{
+			Type:        "Point",
+			Coordinates: [2]float32{loc.GetLongitude(), loc.GetLatitude()},
+		},
+		Properties: loc,
+	})
+}
+
+type geoJSONLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float32 `json:"coordinates"`
+}
+
+type tripProperties struct {
+	TripId     string   `json:"trip_id"`
+	RouteId    string   `json:"route_id"`
+	VehicleIds []string `json:"vehicle_ids"`
+	// Timestamps holds the POSIX time of each point of the line.
+	Timestamps []int64 `json:"timestamps"`
+}
+
+type geoJSONTripFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONLineString `json:"geometry"`
+	Properties tripProperties    `json:"properties"`
+}
+
+// geoJSONLinesWriter writes locations as a FeatureCollection with a
+// LineString tracing each trip in time order. Locations must be given in
+// SortTrip order, so only the trip being written is held.
+type geoJSONLinesWriter struct {
+	*arrayWriter
+	feature  *geoJSONTripFeature
+	vehicles map[string]bool
+}
+
+func newGeoJSONLinesWriter(w io.Writer) (LocationWriter, error) {
+	aw, err := newArrayWriter(w, `{"type":"FeatureCollection","features":`, "}")
+	return &geoJSONLinesWriter{arrayWriter: aw}, err
+}
+
+func (gw *geoJSONLinesWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	if gw.feature != nil && gw.feature.Properties.TripId != loc.GetTripId() {
+		if err := gw.flush(); err != nil {
+			return err
+		}
+	}
+	if gw.feature == nil {
+		gw.feature = &geoJSONTripFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONLineString{Type: "LineString", Coordinates: [][2]float32{}},
+			Properties: tripProperties{TripId: loc.GetTripId(), VehicleIds: []string{}, Timestamps: []int64{}},
+		}
+		gw.vehicles = map[string]bool{}
+	}
+
+	feature := gw.feature
+	feature.Geometry.Coordinates = append(feature.Geometry.Coordinates, [2]float32{loc.GetLongitude(), loc.GetLatitude()})
+	feature.Properties.Timestamps = append(feature.Properties.Timestamps, loc.GetTimestamp())
+	if feature.Properties.RouteId == "" {
+		feature.Properties.RouteId = loc.GetRouteId()
+	}
+	if vehicle := loc.GetVehicleId(); vehicle != "" && !gw.vehicles[vehicle] {
+		gw.vehicles[vehicle] = true
+		feature.Properties.VehicleIds = append(feature.Properties.VehicleIds, vehicle)
+	}
+	return nil
+}
+
+// flush writes the trip being written.
+func (gw *geoJSONLinesWriter) flush() error {
+	feature := gw.feature
+	gw.feature, gw.vehicles = nil, nil
+	return gw.write(feature)
+}
+
+func (gw *geoJSONLinesWriter) Close() error {
+	if gw.feature != nil {
+		if err := gw.flush(); err != nil {
+			return err
+		}
+	}
+	return gw.arrayWriter.Close()
+}
+
+var parquetColumns = []parquet.Column{
+	{Name: "vehicle_id", Type: parquet.String},
+	{Name: "timestamp", Type: parquet.Timestamp},
+	{Name: "speed", Type: parquet.Float},
+	{Name: "route_id", Type: parquet.String},
+	{Name: "trip_id", Type: parquet.String},
+	{Name: "latitude", Type: parquet.Float},
+	{Name: "longitude", Type: parquet.Float},
+	{Name: "bearing", Type: parquet.Float, Optional: true},
+	{Name: "odometer", Type: parquet.Double, Optional: true},
+	{Name: "stop_id", Type: parquet.String, Optional: true},
+	{Name: "current_stop_sequence", Type: parquet.Int64, Optional: true},
+	{Name: "current_status", Type: parquet.String, Optional: true},
+	{Name: "congestion_level", Type: parquet.String, Optional: true},
+	{Name: "occupancy_status", Type: parquet.String, Optional: true},
+	{Name: "start_date", Type: parquet.String, Optional: true},
+	{Name: "start_time", Type: parquet.String, Optional: true},
+	{Name: "vehicle_label", Type: parquet.String, Optional: true},
+}
+
+// parquetWriter writes locations as a Parquet file with the same columns as
+// CSV exports, unset optional fields are null.
+type parquetWriter struct {
+	pw *parquet.Writer
+}
+
+func newParquetWriter(w io.Writer) (LocationWriter, error) {
+	pw, err := parquet.NewWriter(w, parquetColumns)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetWriter{pw}, nil
+}
+
+func (pw *parquetWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	return pw.pw.Write([]interface{}{
+		loc.GetVehicleId(),
+		loc.GetTimestamp(),
+		loc.GetSpeed(),
+		loc.GetRouteId(),
+		loc.GetTripId(),
+		loc.GetLatitude(),
+		loc.GetLongitude(),
+		optionalValue(loc.Bearing != nil, loc.GetBearing()),
+		optionalValue(loc.Odometer != nil, loc.GetOdometer()),
+		optionalValue(loc.StopId != nil, loc.GetStopId()),
+		optionalValue(loc.CurrentStopSequence != nil, int64(loc.GetCurrentStopSequence())),
+		optionalValue(loc.CurrentStatus != nil, loc.GetCurrentStatus()),
+		optionalValue(loc.CongestionLevel != nil, loc.GetCongestionLevel()),
+		optionalValue(loc.OccupancyStatus != nil, loc.GetOccupancyStatus()),
+		optionalValue(loc.StartDate != nil, loc.GetStartDate()),
+		optionalValue(loc.StartTime != nil, loc.GetStartTime()),
+		optionalValue(loc.VehicleLabel != nil, loc.GetVehicleLabel()),
+	})
+}
+
+// optionalValue returns v, or nil for a null if it isn't set.
+func optionalValue(isSet bool, v interface{}) interface{} {
+	if !isSet {
+		return nil
+	}
+	return v
+}
+
+func (pw *parquetWriter) Close() error {
+	return pw.pw.Close()
+}
+
+// feedEntity rebuilds the VehiclePosition a location was captured from.
+func feedEntity(id string, loc *gtfsrt.VehicleLocation) *gtfsrt.FeedEntity {
+	position := &gtfsrt.VehiclePosition{
+		Trip: &gtfsrt.TripDescriptor{
+			TripId:    loc.TripId,
+			RouteId:   loc.RouteId,
+			StartDate: loc.StartDate,
+			StartTime: loc.StartTime,
+		},
+		Position: &gtfsrt.Position{
+			Latitude:  proto.Float32(loc.GetLatitude()),
+			Longitude: proto.Float32(loc.GetLongitude()),
+			Bearing:   loc.Bearing,
+			Odometer:  loc.Odometer,
+			Speed:     loc.Speed,
+		},
+		StopId:              loc.StopId,
+		CurrentStopSequence: loc.CurrentStopSequence,
+		Timestamp:           proto.Uint64(uint64(loc.GetTimestamp())),
+	}
+	if loc.VehicleId != nil || loc.VehicleLabel != nil {
+		position.Vehicle = &gtfsrt.VehicleDescriptor{Id: loc.VehicleId, Label: loc.VehicleLabel}
+	}
+
+	// enums are stored by name, names this version doesn't know are dropped
+	if v, ok := gtfsrt.VehiclePosition_VehicleStopStatus_value[loc.GetCurrentStatus()]; ok {
+		position.CurrentStatus = gtfsrt.VehiclePosition_VehicleStopStatus(v).Enum()
+	}
+	if v, ok := gtfsrt.VehiclePosition_CongestionLevel_value[loc.GetCongestionLevel()]; ok {
+		position.CongestionLevel = gtfsrt.VehiclePosition_CongestionLevel(v).Enum()
+	}
+	if v, ok := gtfsrt.VehiclePosition_OccupancyStatus_value[loc.GetOccupancyStatus()]; ok {
+		position.OccupancyStatus = gtfsrt.VehiclePosition_OccupancyStatus(v).Enum()
+	}
+	return &gtfsrt.FeedEntity{Id: proto.String(id), Vehicle: position}
+}
+
+// gtfsRealtimeWriter writes locations as a series of GTFS-realtime
+// FeedMessages, each holding the latest location of every vehicle during a
+// SnapshotInterval, so archived data can be replayed into GTFS-realtime
+// consumers. Each message is preceded by its length as a varint, as in a
+// protobuf delimited stream. Locations must be given in SortTime order, so
+// only the snapshot being written is held.
+type gtfsRealtimeWriter struct {
+	w        io.Writer
+	snapshot int64
+	last     int64
+	ids      []string
+	latest   map[string]*gtfsrt.VehicleLocation
+}
+
+func newGTFSRealtimeWriter(w io.Writer) (LocationWriter, error) {
+	return &gtfsRealtimeWriter{w: w}, nil
+}
+
+func (gw *gtfsRealtimeWriter) Write(loc *gtfsrt.VehicleLocation) error {
+	snapshot := loc.GetTimestamp() / int64(SnapshotInterval/time.Second)
+	if gw.latest != nil && snapshot != gw.snapshot {
+		if err := gw.flush(); err != nil {
+			return err
+		}
+	}
+	if gw.latest == nil {
+		gw.snapshot = snapshot
+		gw.latest = map[string]*gtfsrt.VehicleLocation{}
+	}
+
+	// later locations of the same vehicle replace earlier ones
+	id := loc.GetVehicleId()
+	if id == "" {
+		id = loc.GetTripId()
+	}
+	if _, ok := gw.latest[id]; !ok {
+		gw.ids = append(gw.ids, id)
+	}
+	gw.latest[id] = loc
+	gw.last = loc.GetTimestamp()
+	return nil
+}
+
+// flush writes the snapshot being collected as a FeedMessage.
+func (gw *gtfsRealtimeWriter) flush() error {
+	fm := &gtfsrt.FeedMessage{
+		Header: &gtfsrt.FeedHeader{
+			GtfsRealtimeVersion: proto.String("1.0"),
+			Incrementality:      gtfsrt.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(gw.last)),
+		},
+	}
+	for _, id := range gw.ids {
+		fm.Entity = append(fm.Entity, feedEntity(id, gw.latest[id]))
+	}
+	gw.ids, gw.latest = nil, nil
+
+	data, err := proto.Marshal(fm)
+	if err != nil {
+		return err
+	}
+	if _, err = gw.w.Write(proto.EncodeVarint(uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err = gw.w.Write(data)
+	return err
+}
+
+func (gw *gtfsRealtimeWriter) Close() error {
+	if gw.latest == nil {
+		return nil
+	}
+	return gw.flush()
+}
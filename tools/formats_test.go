@@ -0,0 +1,109 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+// export writes the locations matching q in format, sorted as the format
+// needs.
+func export(t *testing.T, locations []*gtfsrt.VehicleLocation, q *LocationQuery, format string) []byte {
+	db, cleanup := testDB(t, locations...)
+	defer cleanup()
+
+	if err := q.SortFor(format); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	lw, err := NewLocationWriter(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ScanLocations(db, q, lw.Write); err != nil {
+		t.Fatal(err)
+	}
+	if err = lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// interleaved returns locations of two trips reporting over the same minute.
+func interleaved() []*gtfsrt.VehicleLocation {
+	var locations []*gtfsrt.VehicleLocation
+	for _, ts := range []int64{1449813600, 1449813615, 1449813630, 1449813645} {
+		locations = append(locations, location("tripA", "v1", "801", ts), location("tripB", "v2", "803", ts+5))
+	}
+	return locations
+}
+
+func TestGTFSRealtimeSnapshots(t *testing.T) {
+	data := export(t, interleaved(), &LocationQuery{Min: 1449813600, Max: 1449813660}, "gtfsrt")
+
+	var got []string
+	for len(data) > 0 {
+		n, size := proto.DecodeVarint(data)
+		if size == 0 || uint64(len(data)-size) < n {
+			t.Fatalf("truncated message: %x", data)
+		}
+		var fm gtfsrt.FeedMessage
+		if err := proto.Unmarshal(data[size:size+int(n)], &fm); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := fmt.Sprint(fm.GetHeader().GetTimestamp())
+		for _, e := range fm.Entity {
+			snapshot += fmt.Sprintf(" %s@%d", e.GetId(), e.GetVehicle().GetTimestamp())
+		}
+		got = append(got, snapshot)
+		data = data[size+int(n):]
+	}
+
+	// the latest location of each vehicle in each 30 seconds
+	want := []string{
+		"1449813620 v1@1449813615 v2@1449813620",
+		"1449813650 v1@1449813645 v2@1449813650",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got snapshots %q, want %q", got, want)
+	}
+}
+
+func TestGeoJSONLines(t *testing.T) {
+	data := export(t, interleaved(), &LocationQuery{Min: 1449813600, Max: 1449813660}, "geojson-lines")
+
+	var collection struct {
+		Features []geoJSONTripFeature `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if len(collection.Features) != 2 {
+		t.Fatalf("got %d features, want 2: %s", len(collection.Features), data)
+	}
+	for i, trip := range []string{"tripA", "tripB"} {
+		props := collection.Features[i].Properties
+		if props.TripId != trip || len(props.Timestamps) != 4 || len(props.VehicleIds) != 1 {
+			t.Errorf("feature %d: got %+v, want 4 locations of a vehicle on %s", i, props, trip)
+		}
+	}
+}
+
+func TestSortFor(t *testing.T) {
+	q := &LocationQuery{Vehicles: []string{"v1"}}
+	if err := q.SortFor("gtfsrt"); err != nil || q.Sort != SortTime {
+		t.Errorf("got sort %q, %v for gtfsrt, want %s", q.Sort, err, SortTime)
+	}
+	q = &LocationQuery{Sort: SortVehicle}
+	if err := q.SortFor("geojson-lines"); err == nil {
+		t.Error("geojson-lines sorted by vehicle")
+	}
+	q = &LocationQuery{Sort: SortVehicle}
+	if err := q.SortFor("csv"); err != nil || q.Sort != SortVehicle {
+		t.Errorf("got sort %q, %v for csv, want %s", q.Sort, err, SortVehicle)
+	}
+}
@@ -2,7 +2,7 @@ package tools
 
 import (
 	"bytes"
-	"encoding/csv"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
 	"github.com/scascketta/capmetricsd/daemon"
@@ -10,94 +10,318 @@ import (
 
 	"log"
 	"os"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 )
 
-func readBoltData(db *bolt.DB, min, max string) (*[]gtfsrt.VehicleLocation, error) {
-	locations := []gtfsrt.VehicleLocation{}
+// LocationQuery selects archived vehicle locations between two POSIX
+// timestamps, optionally limited to some routes, trips or vehicles and to a
+// bounding box. Routes, trips and vehicles may be given as patterns with the
+// wildcards * and ?, e.g. "80*", as described by parseGlob.
+type LocationQuery struct {
+	Min      int64
+	Max      int64
+	Routes   []string
+	Trips    []string
+	Vehicles []string
+	BBox     *BBox
+	// Sort is the order to read locations in: SortTrip (by trip and then
+	// time), SortTime or SortVehicle (by vehicle and then time). It defaults
+	// to SortVehicle if vehicles are selected, otherwise SortTrip.
+	Sort string
+}
 
-	err := db.View(func(tx *bolt.Tx) error {
-		topBucket := tx.Bucket([]byte(daemon.BUCKET_NAME))
+// Validate checks the query's sort order is one of the known orders.
+func (q *LocationQuery) Validate() error {
+	switch q.Sort {
+	case "", SortTrip, SortTime, SortVehicle:
+	default:
+		return fmt.Errorf("unknown sort order %s, expected %s, %s or %s", q.Sort, SortTrip, SortTime, SortVehicle)
+	}
+	return nil
+}
 
-		err := topBucket.ForEach(func(tripID, _ []byte) error {
-			tripBucket := topBucket.Bucket(tripID)
-			c := tripBucket.Cursor()
+// formatOrders holds the order locations have to be read in for the formats
+// which group them as they're written.
+var formatOrders = map[string]string{
+	"geojson-lines": SortTrip,
+	"gtfsrt":        SortTime,
+}
 
-			for k, v := c.Seek([]byte(min)); k != nil && bytes.Compare(k, []byte(max)) <= 0; k, v = c.Next() {
-				var loc gtfsrt.VehicleLocation
-				if err := proto.Unmarshal(v, &loc); err != nil {
-					return err
-				}
+// SortFor sets the query's sort order to the one format needs, if it needs
+// one, failing if a different order was asked for.
+func (q *LocationQuery) SortFor(format string) error {
+	order, ok := formatOrders[format]
+	if !ok {
+		return nil
+	}
+	if q.Sort != "" && q.Sort != order {
+		return fmt.Errorf("%s locations can only be sorted by %s", format, order)
+	}
+	q.Sort = order
+	return nil
+}
 
-				locations = append(locations, loc)
-			}
+func (q *LocationQuery) order() string {
+	if q.Sort != "" {
+		return q.Sort
+	}
+	if len(q.Vehicles) > 0 {
+		return SortVehicle
+	}
+	return SortTrip
+}
 
-			return nil
-		})
+func (q *LocationQuery) matches(loc *gtfsrt.VehicleLocation) bool {
+	if len(q.Routes) > 0 && !matchAny(q.Routes, loc.GetRouteId()) {
+		return false
+	}
+	if len(q.Vehicles) > 0 && !matchAny(q.Vehicles, loc.GetVehicleId()) {
+		return false
+	}
+	if q.BBox != nil && !q.BBox.contains(loc.GetLongitude(), loc.GetLatitude()) {
+		return false
+	}
+	return true
+}
 
-		return err
-	})
+// bucketKeys returns a copy of the keys of a nested bucket, or nil if it
+// doesn't exist.
+func bucketKeys(parent *bolt.Bucket, name []byte) [][]byte {
+	if parent == nil {
+		return nil
+	}
+	b := parent.Bucket(name)
+	if b == nil {
+		return nil
+	}
 
-	return &locations, err
+	var keys [][]byte
+	b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	return keys
 }
 
-func writeData(dest string, locations *[]gtfsrt.VehicleLocation) error {
-	log.Printf("Writing %d vehicle locations to %s.\n", len(*locations), dest)
+// indexedTrips uses the time and route indexes to find the trips which may
+// have locations matching q.
+func indexedTrips(tx *bolt.Tx, q *LocationQuery) []string {
+	trips := map[string]bool{}
+	if timeIndex := tx.Bucket([]byte(daemon.TIME_INDEX_BUCKET_NAME)); timeIndex != nil {
+		c := timeIndex.Cursor()
+		for k, _ := c.Seek(daemon.TimeIndexKey(q.Min)); k != nil && daemon.KeyTime(k) <= q.Max; k, _ = c.Next() {
+			for _, trip := range bucketKeys(timeIndex, k) {
+				trips[string(trip)] = true
+			}
+		}
+	}
 
-	headers := []string{"vehicle_id", "timestamp", "speed", "route_id", "trip_id", "latitude", "longitude"}
+	if len(q.Routes) > 0 {
+		routeIndex := tx.Bucket([]byte(daemon.ROUTE_INDEX_BUCKET_NAME))
+		onRoutes := map[string]bool{}
+		for _, route := range matchingKeys(routeIndex, q.Routes) {
+			for _, trip := range bucketKeys(routeIndex, route) {
+				onRoutes[string(trip)] = true
+			}
+		}
+		for trip := range trips {
+			if !onRoutes[trip] {
+				delete(trips, trip)
+			}
+		}
+	}
 
-	f, err := os.Create(dest)
-	if err != nil {
-		return err
+	list := make([]string, 0, len(trips))
+	for trip := range trips {
+		list = append(list, trip)
+	}
+	return list
+}
+
+// candidateTrips returns the trips which may have locations matching q,
+// sorted by trip ID. The indexes are used to avoid visiting every trip, unless
+// the database was written before they were added and hasn't been reindexed.
+func candidateTrips(tx *bolt.Tx, topBucket *bolt.Bucket, q *LocationQuery) [][]byte {
+	var trips [][]byte
+
+	switch {
+	case len(q.Trips) > 0:
+		trips = matchingKeys(topBucket, q.Trips)
+	case !daemon.IndexesComplete(tx):
+		log.Println("Database isn't fully indexed, scanning every trip. Run capmetricsd reindex to speed up queries.")
+		topBucket.ForEach(func(tripID, _ []byte) error {
+			trips = append(trips, append([]byte{}, tripID...))
+			return nil
+		})
+	case len(q.Vehicles) > 0:
+		// the vehicle index has an entry for each of a vehicle's locations on
+		// each trip, keyed by time first and holding the trip ID
+		vehicleIndex := tx.Bucket([]byte(daemon.VEHICLE_INDEX_BUCKET_NAME))
+		seen := map[string]bool{}
+		for _, vehicle := range matchingKeys(vehicleIndex, q.Vehicles) {
+			c := vehicleIndex.Bucket(vehicle).Cursor()
+			for k, trip := c.Seek(daemon.TimeKey(q.Min)); k != nil && daemon.KeyTime(k) <= q.Max; k, trip = c.Next() {
+				if !seen[string(trip)] {
+					seen[string(trip)] = true
+					trips = append(trips, append([]byte{}, trip...))
+				}
+			}
+		}
+	default:
+		for _, trip := range indexedTrips(tx, q) {
+			trips = append(trips, []byte(trip))
+		}
 	}
-	defer f.Close()
 
-	w := csv.NewWriter(f)
-	if err = w.Write(headers); err != nil {
-		log.Println("Error writing CSV header record")
+	sort.Sort(byteSlices(trips))
+	return trips
+}
+
+type byteSlices [][]byte
+
+func (b byteSlices) Len() int           { return len(b) }
+func (b byteSlices) Less(i, j int) bool { return bytes.Compare(b[i], b[j]) < 0 }
+func (b byteSlices) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// ScanLocations calls fn with each location matching q as it's read, in the
+// order given by q.Sort.
+//
+// fn is called within a read transaction, which is held open until the scan
+// finishes.
+func ScanLocations(db daemon.Viewer, q *LocationQuery, fn func(loc *gtfsrt.VehicleLocation) error) error {
+	if err := q.Validate(); err != nil {
 		return err
 	}
 
-	for _, loc := range *locations {
-		t := time.Unix(loc.GetTimestamp(), 0).UTC()
-		record := []string{
-			loc.GetVehicleId(),
-			t.Local().Format(Iso8601Format),
-			strconv.FormatFloat(float64(loc.GetSpeed()), 'f', -1, 32),
-			loc.GetRouteId(),
-			loc.GetTripId(),
-			strconv.FormatFloat(float64(loc.GetLatitude()), 'f', -1, 32),
-			strconv.FormatFloat(float64(loc.GetLongitude()), 'f', -1, 32),
+	return db.View(func(tx *bolt.Tx) error {
+		topBucket := tx.Bucket([]byte(daemon.BUCKET_NAME))
+		if topBucket == nil {
+			return fmt.Errorf("Nonexistent bucket: %s", daemon.BUCKET_NAME)
 		}
-		if err = w.Write(record); err != nil {
-			log.Println("Error writing CSV records")
+		if err := daemon.CheckKeyFormat(tx); err != nil {
 			return err
 		}
+
+		add := func(v []byte) error {
+			loc := new(gtfsrt.VehicleLocation)
+			if err := proto.Unmarshal(v, loc); err != nil {
+				return err
+			}
+
+			if q.matches(loc) {
+				return fn(loc)
+			}
+			return nil
+		}
+
+		trips := candidateTrips(tx, topBucket, q)
+		if q.order() != SortTrip {
+			return mergeTrips(topBucket, trips, q, q.order(), add)
+		}
+
+		for _, trip := range trips {
+			tripBucket := topBucket.Bucket(trip)
+			if tripBucket == nil {
+				continue
+			}
+			c := tripBucket.Cursor()
+			for k, v := c.Seek(daemon.TimeKey(q.Min)); k != nil && daemon.KeyTime(k) <= q.Max; k, v = c.Next() {
+				if err := add(v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// openDB opens a database for the offline tools, failing quickly rather than
+// waiting forever if the daemon holds its lock.
+func openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is locked by another process. If capmetricsd is capturing it, query the daemon's HTTP API instead", path)
 	}
+	return db, err
+}
 
-	w.Flush()
-	if err := w.Error(); err != nil {
-		return err
+// ParseTimeRange parses the bounds of a query given as arguments, in any of
+// the forms TimeRange accepts. Like To, max is exclusive, and the last time
+// returned is the second before it.
+func ParseTimeRange(min, max string) (minTime, maxTime int64, err error) {
+	if min == "" || max == "" {
+		return 0, 0, fmt.Errorf("min and max must both be given")
 	}
+	r := &TimeRange{From: min, To: max}
+	return r.Resolve(time.Now())
+}
 
-	return nil
+// ExportOptions controls how GetData writes locations.
+type ExportOptions struct {
+	// Format is one of LocationFormats.
+	Format string
+	// Compression is "gzip" or "none". If empty, gzip is used when the
+	// destination ends with .gz.
+	Compression string
 }
 
-func GetData(dbPath, dest string, min string, max string) error {
-	log.Printf("Get data between %s and %s\n", min, max)
+// GetData exports the locations matching q to dest, or to stdout if dest is
+// "-". Locations are written as they're read rather than being held in memory.
+func GetData(dbPath, dest string, q *LocationQuery, opts *ExportOptions) (err error) {
+	if !IsLocationFormat(opts.Format) {
+		return fmt.Errorf("unknown format %s, expected one of %s", opts.Format, strings.Join(LocationFormats(), ", "))
+	}
+	if err = q.SortFor(opts.Format); err != nil {
+		return err
+	}
+	if err = q.Validate(); err != nil {
+		return err
+	}
+	compression, err := outputCompression(dest, opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Get data between %s and %s\n",
+		time.Unix(q.Min, 0).Local().Format(Iso8601Format), time.Unix(q.Max, 0).Local().Format(Iso8601Format))
 
 	log.Println("dbPath: ", dbPath)
-	db, err := bolt.Open(dbPath, 0600, nil)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out, err := createOutput(dest, compression)
 	if err != nil {
 		return err
 	}
+	// a partial export would look like a complete one, so it's removed
+	defer func() {
+		out.Close()
+		if err != nil && dest != "-" {
+			os.Remove(dest)
+		}
+	}()
 
-	locations, err := readBoltData(db, min, max)
+	lw, err := NewLocationWriter(out, opts.Format)
 	if err != nil {
 		return err
 	}
+	progress := newProgress(lw)
+
+	if err = ScanLocations(db, q, progress.Write); err != nil {
+		return err
+	}
+	if err = progress.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
 
-	err = writeData(dest, locations)
-	return err
+	log.Printf("Wrote %d vehicle locations to %s as %s in %s.\n", progress.count, dest, opts.Format, time.Now().Sub(progress.start))
+	return nil
 }
@@ -0,0 +1,141 @@
+package tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+func location(trip, vehicle, route string, ts int64) *gtfsrt.VehicleLocation {
+	return &gtfsrt.VehicleLocation{TripId: proto.String(trip), VehicleId: proto.String(vehicle), RouteId: proto.String(route), Timestamp: proto.Int64(ts)}
+}
+
+// testDB creates a database in a temporary directory holding locations, stored
+// and indexed like the daemon does. The directory is removed by the returned
+// func.
+func testDB(t *testing.T, locations ...*gtfsrt.VehicleLocation) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "capmetricsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.boltdb"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	err = daemon.PrepareDB(db)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			topBucket, err := daemon.CreateLocationsBucket(tx)
+			if err != nil {
+				return err
+			}
+			for _, loc := range locations {
+				tripBucket, err := topBucket.CreateBucketIfNotExists([]byte(loc.GetTripId()))
+				if err != nil {
+					return err
+				}
+				data, err := proto.Marshal(loc)
+				if err != nil {
+					return err
+				}
+				key := daemon.LocationKey(loc.GetTimestamp(), loc.GetVehicleId())
+				if err = tripBucket.Put(key, data); err != nil {
+					return err
+				}
+				if err = daemon.IndexLocation(tx, []byte(loc.GetTripId()), key, loc); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return db, cleanup
+}
+
+// scan returns the locations matching q as trip:vehicle@time strings.
+func scan(t *testing.T, db daemon.Viewer, q *LocationQuery) []string {
+	var got []string
+	err := ScanLocations(db, q, func(loc *gtfsrt.VehicleLocation) error {
+		got = append(got, fmt.Sprintf("%s:%s@%d", loc.GetTripId(), loc.GetVehicleId(), loc.GetTimestamp()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestScanLocationsInterlined(t *testing.T) {
+	// v1 reports on tripA and tripB at the same times as it's interlined
+	var locations []*gtfsrt.VehicleLocation
+	for _, ts := range []int64{1449813600, 1449813630, 1449813660} {
+		locations = append(locations, location("tripA", "v1", "801", ts), location("tripB", "v1", "803", ts))
+	}
+	locations = append(locations, location("tripC", "v2", "801", 1449813630))
+	db, cleanup := testDB(t, locations...)
+	defer cleanup()
+
+	all := scan(t, db, &LocationQuery{Min: 1449813600, Max: 1449813660})
+	byVehicle := scan(t, db, &LocationQuery{Min: 1449813600, Max: 1449813660, Vehicles: []string{"v1"}, Sort: SortTrip})
+	if len(all) != 7 {
+		t.Errorf("got %d locations, want 7: %v", len(all), all)
+	}
+	if len(byVehicle) != 6 {
+		t.Errorf("got %d locations of v1, want 6: %v", len(byVehicle), byVehicle)
+	}
+}
+
+func TestGetDataLeavesNoPartialOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capmetricsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "out.csv")
+
+	// a database without any locations bucket fails once the export has
+	// started
+	empty := filepath.Join(dir, "empty.boltdb")
+	db, err := bolt.Open(empty, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	tests := []struct {
+		name string
+		q    LocationQuery
+		opts ExportOptions
+	}{
+		{"unknown sort", LocationQuery{Sort: "route"}, ExportOptions{Format: "csv"}},
+		{"sort the format can't use", LocationQuery{Sort: SortVehicle}, ExportOptions{Format: "gtfsrt"}},
+		{"unknown compression", LocationQuery{}, ExportOptions{Format: "csv", Compression: "zip"}},
+		{"failed scan", LocationQuery{}, ExportOptions{Format: "csv"}},
+	}
+	for _, test := range tests {
+		q := test.q
+		if err = GetData(empty, dest, &q, &test.opts); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		if _, err = os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("%s: output was left behind: %v", test.name, err)
+		}
+	}
+}
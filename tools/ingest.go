@@ -87,7 +87,7 @@ func unmarshalCSV(record []string) *gtfsrt.VehicleLocation {
 
 func storeBolt(record []string) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
-		topBucket, err := tx.CreateBucketIfNotExists([]byte(daemon.BUCKET_NAME))
+		topBucket, err := daemon.CreateLocationsBucket(tx)
 		if err != nil {
 			return err
 		}
@@ -106,14 +106,13 @@ func storeBolt(record []string) func(tx *bolt.Tx) error {
 			return err
 		}
 
-		ts := loc.GetTimestamp()
-		key := strconv.Itoa(int(ts))
+		key := daemon.LocationKey(loc.GetTimestamp(), loc.GetVehicleId())
 
-		err = tripBucket.Put([]byte(key), data)
+		err = tripBucket.Put(key, data)
 		if err != nil {
 			return err
 		}
-		return nil
+		return daemon.IndexLocation(tx, []byte(tripID), key, loc)
 	}
 }
 
@@ -170,6 +169,11 @@ func Ingest(pattern string) {
 	}
 
 	defer db.Close()
+
+	if err = daemon.PrepareDB(db); err != nil {
+		elog.Fatal(err)
+	}
+
 	files, _ := filepath.Glob(pattern)
 	log.Printf("# of Files found with pattern %s: %v\n", pattern, len(files))
 	total := 0
@@ -0,0 +1,27 @@
+package tools
+
+import (
+	"github.com/scascketta/capmetricsd/daemon"
+	"log"
+	"time"
+)
+
+// Migrate rewrites a database written with decimal timestamp keys to use the
+// current key format.
+func Migrate(dbPath string) error {
+	log.Println("Migrating DB at:", dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	count, err := daemon.Migrate(db)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rewrote %d keys in %s\n", count, time.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProgressInterval is how often exports log the number of locations written.
+const ProgressInterval = 5 * time.Second
+
+// output is the destination of an export, which may be compressed.
+type output struct {
+	io.Writer
+	// closers are closed in order, compressors before the file they write to.
+	closers []io.Closer
+}
+
+// Close flushes and closes the output. It's safe to call more than once.
+func (o *output) Close() (err error) {
+	for _, c := range o.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	o.closers = nil
+	return
+}
+
+// outputCompression returns the compression to write dest with: "gzip" or
+// "none", or if compression is empty gzip for destinations ending in .gz.
+func outputCompression(dest, compression string) (string, error) {
+	if compression == "" {
+		compression = "none"
+		if strings.HasSuffix(dest, ".gz") {
+			compression = "gzip"
+		}
+	}
+	switch compression {
+	case "none", "gzip":
+		return compression, nil
+	default:
+		return "", fmt.Errorf("unknown compression: %s", compression)
+	}
+}
+
+// createOutput creates dest for writing, or writes to stdout if dest is "-".
+// compression is as returned by outputCompression.
+func createOutput(dest, compression string) (*output, error) {
+	out := &output{Writer: os.Stdout}
+	if dest != "-" {
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		out.Writer = f
+		out.closers = append(out.closers, f)
+	}
+
+	if compression == "gzip" {
+		gz := gzip.NewWriter(out.Writer)
+		out.Writer = gz
+		out.closers = append([]io.Closer{gz}, out.closers...)
+	}
+	return out, nil
+}
+
+// progress counts the locations written by a LocationWriter, logging the
+// count every ProgressInterval.
+type progress struct {
+	LocationWriter
+	count   int
+	start   time.Time
+	lastLog time.Time
+}
+
+func newProgress(lw LocationWriter) *progress {
+	now := time.Now()
+	return &progress{LocationWriter: lw, start: now, lastLog: now}
+}
+
+func (p *progress) Write(loc *gtfsrt.VehicleLocation) error {
+	if err := p.LocationWriter.Write(loc); err != nil {
+		return err
+	}
+	p.count++
+
+	if now := time.Now(); now.Sub(p.lastLog) >= ProgressInterval {
+		p.lastLog = now
+		elapsed := now.Sub(p.start).Seconds()
+		log.Printf("Wrote %d vehicle locations (%.0f per second)\n", p.count, float64(p.count)/elapsed)
+	}
+	return nil
+}
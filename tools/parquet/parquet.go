@@ -0,0 +1,347 @@
+// Package parquet writes flat tables as Apache Parquet files. It supports only
+// what capmetricsd's exports need: required or optional columns of a few
+// primitive types, PLAIN encoding and no compression, which any Parquet reader
+// can load.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// RowGroupSize is the number of rows buffered in memory before they're
+// written out as a row group.
+const RowGroupSize = 100000
+
+var magic = []byte("PAR1")
+
+// ColumnType is the type of a column's values.
+type ColumnType int
+
+const (
+	// String columns hold UTF-8 strings.
+	String ColumnType = iota
+	// Int64 columns hold int64s.
+	Int64
+	// Float columns hold float32s.
+	Float
+	// Double columns hold float64s.
+	Double
+	// Timestamp columns hold POSIX times in seconds as int64s, which are
+	// stored as milliseconds since that's what readers recognize.
+	Timestamp
+)
+
+// Parquet's physical types, converted types and other enums.
+const (
+	typeInt64     = 2
+	typeFloat     = 4
+	typeDouble    = 5
+	typeByteArray = 6
+
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+
+	pageTypeData = 0
+)
+
+// Column describes a column of a table. Optional columns may hold nulls.
+type Column struct {
+	Name     string
+	Type     ColumnType
+	Optional bool
+}
+
+func (c Column) repetition() int32 {
+	if c.Optional {
+		return repetitionOptional
+	}
+	return repetitionRequired
+}
+
+func (c Column) physicalType() int32 {
+	switch c.Type {
+	case Int64, Timestamp:
+		return typeInt64
+	case Float:
+		return typeFloat
+	case Double:
+		return typeDouble
+	}
+	return typeByteArray
+}
+
+// check returns an error if a value can't be stored in the column.
+func (c Column) check(value interface{}) error {
+	switch value.(type) {
+	case nil:
+		if !c.Optional {
+			return fmt.Errorf("column %s can't hold nulls", c.Name)
+		}
+	case string:
+		if c.Type != String {
+			return fmt.Errorf("column %s can't hold a string", c.Name)
+		}
+	case int64:
+		if c.Type != Int64 && c.Type != Timestamp {
+			return fmt.Errorf("column %s can't hold an int64", c.Name)
+		}
+	case float32:
+		if c.Type != Float {
+			return fmt.Errorf("column %s can't hold a float32", c.Name)
+		}
+	case float64:
+		if c.Type != Double {
+			return fmt.Errorf("column %s can't hold a float64", c.Name)
+		}
+	default:
+		return fmt.Errorf("unsupported value %v in column %s", value, c.Name)
+	}
+	return nil
+}
+
+// columnChunk records where a column of a row group was written.
+type columnChunk struct {
+	offset int64
+	size   int64
+}
+
+type rowGroup struct {
+	rows    int64
+	columns []columnChunk
+}
+
+// Writer writes rows to a Parquet file. Close must be called to write the
+// file's footer.
+type Writer struct {
+	w       io.Writer
+	offset  int64
+	columns []Column
+	// values holds the PLAIN encoded values of each column in the current
+	// row group, and defined whether each row's value is non-null.
+	values    []bytes.Buffer
+	defined   [][]bool
+	rows      int64
+	rowGroups []rowGroup
+}
+
+// NewWriter starts a Parquet file with the given columns on w.
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	pw := &Writer{
+		w:       w,
+		columns: columns,
+		values:  make([]bytes.Buffer, len(columns)),
+		defined: make([][]bool, len(columns)),
+	}
+	if err := pw.write(magic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) write(data []byte) error {
+	n, err := pw.w.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write adds a row, which must have a value of the right type for each column:
+// string for String columns, int64 for Int64 and Timestamp columns, float32
+// for Float columns and float64 for Double columns. Optional columns may be
+// given nil. A row with the wrong values isn't written at all.
+func (pw *Writer) Write(row []interface{}) error {
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("row has %d values, expected %d", len(row), len(pw.columns))
+	}
+	for i, value := range row {
+		if err := pw.columns[i].check(value); err != nil {
+			return err
+		}
+	}
+
+	for i, value := range row {
+		if pw.columns[i].Optional {
+			pw.defined[i] = append(pw.defined[i], value != nil)
+		}
+
+		buf := &pw.values[i]
+		switch v := value.(type) {
+		case string:
+			binary.Write(buf, binary.LittleEndian, uint32(len(v)))
+			buf.WriteString(v)
+		case int64:
+			if pw.columns[i].Type == Timestamp {
+				v *= 1000
+			}
+			binary.Write(buf, binary.LittleEndian, v)
+		case float32:
+			binary.Write(buf, binary.LittleEndian, math.Float32bits(v))
+		case float64:
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(v))
+		}
+	}
+
+	pw.rows++
+	if pw.rows >= RowGroupSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group, with each column stored as a
+// single data page.
+func (pw *Writer) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	group := rowGroup{rows: pw.rows}
+	for i, column := range pw.columns {
+		values := pw.values[i].Bytes()
+		if column.Optional {
+			values = append(definitionLevels(pw.defined[i]), values...)
+			pw.defined[i] = pw.defined[i][:0]
+		}
+
+		header := newCompactWriter()
+		header.i32(1, pageTypeData)
+		header.i32(2, int32(len(values)))
+		header.i32(3, int32(len(values)))
+		header.beginStruct(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.endStruct()
+		header.WriteByte(0)
+
+		chunk := columnChunk{offset: pw.offset, size: int64(header.Len() + len(values))}
+		if err := pw.write(header.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(values); err != nil {
+			return err
+		}
+		group.columns = append(group.columns, chunk)
+		pw.values[i].Reset()
+	}
+
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.rows = 0
+	return nil
+}
+
+// Close writes any buffered rows and the file's footer. It doesn't close the
+// underlying writer.
+func (pw *Writer) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, group := range pw.rowGroups {
+		total += group.rows
+	}
+
+	meta := newCompactWriter()
+	meta.i32(1, 1)
+
+	meta.list(2, compactStruct, len(pw.columns)+1)
+	meta.beginStruct(0)
+	meta.string(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, column := range pw.columns {
+		meta.beginStruct(0)
+		meta.i32(1, column.physicalType())
+		meta.i32(3, column.repetition())
+		meta.string(4, column.Name)
+		switch column.Type {
+		case String:
+			meta.i32(6, convertedUTF8)
+		case Timestamp:
+			meta.i32(6, convertedTimestampMillis)
+		}
+		meta.endStruct()
+	}
+
+	meta.i64(3, total)
+
+	meta.list(4, compactStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.beginStruct(0)
+		meta.list(1, compactStruct, len(group.columns))
+		var size int64
+		for i, chunk := range group.columns {
+			column := pw.columns[i]
+			meta.beginStruct(0)
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, column.physicalType())
+			meta.list(2, compactI32, 2)
+			meta.i32Element(encodingPlain)
+			meta.i32Element(encodingRLE)
+			meta.list(3, compactBinary, 1)
+			meta.stringElement(column.Name)
+			meta.i32(4, codecUncompressed)
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+			size += chunk.size
+		}
+		meta.i64(2, size)
+		meta.i64(3, group.rows)
+		meta.endStruct()
+	}
+
+	meta.string(6, "capmetricsd")
+	meta.WriteByte(0)
+
+	if err := pw.write(meta.Bytes()); err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(meta.Len()))
+	if err := pw.write(length); err != nil {
+		return err
+	}
+	return pw.write(magic)
+}
+
+// definitionLevels encodes whether each value of an optional column is
+// non-null, as the levels preceding the values of a data page. With a maximum
+// level of 1 these are single bits, which are written bit-packed with the
+// RLE/bit-packing hybrid encoding and prefixed by their length.
+func definitionLevels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(groups<<1|1))
+	levels := append([]byte{}, buf[:n]...)
+
+	packed := make([]byte, groups)
+	for i, isDefined := range defined {
+		if isDefined {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	levels = append(levels, packed...)
+
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(levels)))
+	return append(length, levels...)
+}
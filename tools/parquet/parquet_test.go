@@ -0,0 +1,435 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// compactReader decodes Thrift structs written with the compact protocol into
+// maps from field IDs to values: int64s for integers, []byte for binary,
+// []interface{} for lists and map[int16]interface{} for structs.
+type compactReader struct {
+	*bytes.Reader
+}
+
+func (c compactReader) varint() uint64 {
+	v, err := binary.ReadUvarint(c)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (c compactReader) zigzag() int64 {
+	v := c.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (c compactReader) byte() byte {
+	b, err := c.ReadByte()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (c compactReader) value(typ byte) interface{} {
+	switch typ {
+	case compactI32, compactI64:
+		return c.zigzag()
+	case compactBinary:
+		v := make([]byte, c.varint())
+		if _, err := c.Read(v); err != nil {
+			panic(err)
+		}
+		return v
+	case compactList:
+		header := c.byte()
+		n, elemType := int(header>>4), header&0x0f
+		if n == 15 {
+			n = int(c.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = c.value(elemType)
+		}
+		return list
+	case compactStruct:
+		return c.structure()
+	}
+	panic(fmt.Sprintf("unexpected type %d", typ))
+}
+
+func (c compactReader) structure() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var id int16
+	for {
+		header := c.byte()
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(c.zigzag())
+		}
+		fields[id] = c.value(header & 0x0f)
+	}
+}
+
+// decodeStruct decodes the struct at the start of data, returning it and its
+// length.
+func decodeStruct(t *testing.T, data []byte) (s map[int16]interface{}, n int) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("decoding struct: %v", r)
+		}
+	}()
+	c := compactReader{bytes.NewReader(data)}
+	s = c.structure()
+	return s, len(data) - c.Len()
+}
+
+func field(t *testing.T, s map[int16]interface{}, id int16) interface{} {
+	v, ok := s[id]
+	if !ok {
+		t.Fatalf("struct has no field %d: %v", id, s)
+	}
+	return v
+}
+
+func i64(t *testing.T, s map[int16]interface{}, id int16) int64 {
+	return field(t, s, id).(int64)
+}
+
+func str(t *testing.T, s map[int16]interface{}, id int16) string {
+	return string(field(t, s, id).([]byte))
+}
+
+func structs(t *testing.T, s map[int16]interface{}, id int16) (list []map[int16]interface{}) {
+	for _, v := range field(t, s, id).([]interface{}) {
+		list = append(list, v.(map[int16]interface{}))
+	}
+	return
+}
+
+// decodeLevels decodes n definition levels with a maximum level of 1, written
+// with the RLE/bit-packing hybrid encoding and prefixed by their length, and
+// returns them with the length of their encoding.
+func decodeLevels(t *testing.T, data []byte, n int) (defined []bool, size int) {
+	length := int(binary.LittleEndian.Uint32(data))
+	c := compactReader{bytes.NewReader(data[4 : 4+length])}
+	for len(defined) < n {
+		header := c.varint()
+		if header&1 == 0 {
+			// a run of one repeated value, which takes a byte at bit width 1
+			value := c.byte() == 1
+			for i := uint64(0); i < header>>1; i++ {
+				defined = append(defined, value)
+			}
+			continue
+		}
+		for g := uint64(0); g < header>>1; g++ {
+			b := c.byte()
+			for bit := uint(0); bit < 8; bit++ {
+				defined = append(defined, b&(1<<bit) != 0)
+			}
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("%d bytes left over after definition levels", c.Len())
+	}
+	return defined[:n], 4 + length
+}
+
+// decodePlain decodes a PLAIN encoded value of a column.
+func decodePlain(t *testing.T, column Column, data []byte) (value interface{}, n int) {
+	switch column.Type {
+	case String:
+		length := int(binary.LittleEndian.Uint32(data))
+		return string(data[4 : 4+length]), 4 + length
+	case Int64:
+		return int64(binary.LittleEndian.Uint64(data)), 8
+	case Timestamp:
+		// stored in milliseconds
+		return int64(binary.LittleEndian.Uint64(data)) / 1000, 8
+	case Float:
+		return math.Float32frombits(binary.LittleEndian.Uint32(data)), 4
+	case Double:
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8
+	}
+	t.Fatalf("unexpected column type %d", column.Type)
+	return nil, 0
+}
+
+// readFile decodes a file written by Writer, checking its structure against
+// the columns it was written with, and returns its rows.
+func readFile(t *testing.T, file []byte, columns []Column) (rows [][]interface{}, rowGroups int) {
+	if !bytes.HasPrefix(file, magic) || !bytes.HasSuffix(file, magic) {
+		t.Fatal("file doesn't start and end with PAR1")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := len(file) - 8 - footerLength
+	meta, n := decodeStruct(t, file[footerStart:len(file)-8])
+	if n != footerLength {
+		t.Errorf("footer is %d bytes, but its length is given as %d", n, footerLength)
+	}
+
+	if version := i64(t, meta, 1); version != 1 {
+		t.Errorf("got version %d, want 1", version)
+	}
+
+	schema := structs(t, meta, 2)
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("got %d schema elements, want %d", len(schema), len(columns)+1)
+	}
+	if children := i64(t, schema[0], 5); children != int64(len(columns)) {
+		t.Errorf("root of schema has %d children, want %d", children, len(columns))
+	}
+	for i, column := range columns {
+		element := schema[i+1]
+		if name := str(t, element, 4); name != column.Name {
+			t.Errorf("column %d: got name %q, want %q", i, name, column.Name)
+		}
+		if typ := i64(t, element, 1); typ != int64(column.physicalType()) {
+			t.Errorf("%s: got type %d, want %d", column.Name, typ, column.physicalType())
+		}
+		if repetition := i64(t, element, 3); repetition != int64(column.repetition()) {
+			t.Errorf("%s: got repetition %d, want %d", column.Name, repetition, column.repetition())
+		}
+		converted, ok := element[6]
+		switch column.Type {
+		case String:
+			if converted != int64(convertedUTF8) {
+				t.Errorf("%s: got converted type %v, want UTF8", column.Name, converted)
+			}
+		case Timestamp:
+			if converted != int64(convertedTimestampMillis) {
+				t.Errorf("%s: got converted type %v, want TIMESTAMP_MILLIS", column.Name, converted)
+			}
+		default:
+			if ok {
+				t.Errorf("%s: got converted type %v, want none", column.Name, converted)
+			}
+		}
+	}
+
+	groups := structs(t, meta, 4)
+	var total int64
+	for g, group := range groups {
+		groupRows := int(i64(t, group, 3))
+		total += int64(groupRows)
+		groupValues := make([][]interface{}, groupRows)
+		for i := range groupValues {
+			groupValues[i] = make([]interface{}, len(columns))
+		}
+
+		var groupSize int64
+		chunks := structs(t, group, 1)
+		if len(chunks) != len(columns) {
+			t.Fatalf("row group %d has %d columns, want %d", g, len(chunks), len(columns))
+		}
+		for c, chunk := range chunks {
+			column := columns[c]
+			chunkMeta := field(t, chunk, 3).(map[int16]interface{})
+			offset := i64(t, chunkMeta, 9)
+			if fileOffset := i64(t, chunk, 2); fileOffset != offset {
+				t.Errorf("%s: chunk's file offset %d isn't its data page offset %d", column.Name, fileOffset, offset)
+			}
+			if path := field(t, chunkMeta, 3).([]interface{}); len(path) != 1 || string(path[0].([]byte)) != column.Name {
+				t.Errorf("%s: got path %q", column.Name, path)
+			}
+			if numValues := i64(t, chunkMeta, 5); numValues != int64(groupRows) {
+				t.Errorf("%s: got %d values, want %d", column.Name, numValues, groupRows)
+			}
+			size := i64(t, chunkMeta, 6)
+			groupSize += size
+
+			header, headerSize := decodeStruct(t, file[offset:])
+			if pageType := i64(t, header, 1); pageType != pageTypeData {
+				t.Errorf("%s: got page type %d, want a data page", column.Name, pageType)
+			}
+			pageSize := i64(t, header, 3)
+			if compressed := i64(t, header, 2); compressed != pageSize {
+				t.Errorf("%s: compressed size %d isn't the uncompressed size %d", column.Name, compressed, pageSize)
+			}
+			if int64(headerSize)+pageSize != size {
+				t.Errorf("%s: page takes %d bytes, but the chunk is %d", column.Name, int64(headerSize)+pageSize, size)
+			}
+			dataPage := field(t, header, 5).(map[int16]interface{})
+			if numValues := i64(t, dataPage, 1); numValues != int64(groupRows) {
+				t.Errorf("%s: page has %d values, want %d", column.Name, numValues, groupRows)
+			}
+			if encoding := i64(t, dataPage, 2); encoding != encodingPlain {
+				t.Errorf("%s: got encoding %d, want PLAIN", column.Name, encoding)
+			}
+
+			page := file[offset+int64(headerSize) : offset+int64(headerSize)+pageSize]
+			defined := make([]bool, groupRows)
+			for i := range defined {
+				defined[i] = true
+			}
+			if column.Optional {
+				var levelsSize int
+				defined, levelsSize = decodeLevels(t, page, groupRows)
+				page = page[levelsSize:]
+			}
+			for i, isDefined := range defined {
+				if !isDefined {
+					continue
+				}
+				value, n := decodePlain(t, column, page)
+				groupValues[i][c] = value
+				page = page[n:]
+			}
+			if len(page) != 0 {
+				t.Errorf("%s: %d bytes left over after the values", column.Name, len(page))
+			}
+		}
+		if size := i64(t, group, 2); size != groupSize {
+			t.Errorf("row group %d: got total size %d, want %d", g, size, groupSize)
+		}
+		rows = append(rows, groupValues...)
+	}
+
+	if numRows := i64(t, meta, 3); numRows != total {
+		t.Errorf("file has %d rows, but its row groups have %d", numRows, total)
+	}
+	return rows, len(groups)
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "vehicle_id", Type: String},
+		{Name: "timestamp", Type: Timestamp},
+		{Name: "speed", Type: Float},
+		{Name: "bearing", Type: Float, Optional: true},
+		{Name: "odometer", Type: Double, Optional: true},
+		{Name: "current_stop_sequence", Type: Int64, Optional: true},
+		{Name: "stop_id", Type: String, Optional: true},
+	}
+	// more than 8 rows, so the definition levels take more than one byte, and
+	// columns which are all null or never null
+	rows := [][]interface{}{
+		{"5001", int64(1449813600), float32(4.5), float32(90), 12345.5, int64(3), "1042"},
+		{"5002", int64(1449813601), float32(0), nil, nil, nil, "1043"},
+		{"", int64(1449813602), float32(1), float32(180), nil, int64(4), ""},
+		{"5004", int64(1449813603), float32(2), nil, 1.25, nil, nil},
+	}
+	for i := 0; i < 9; i++ {
+		rows = append(rows, []interface{}{fmt.Sprintf("60%02d", i), int64(1449813700 + i), float32(i), nil, nil, int64(i), nil})
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, groups := readFile(t, buf.Bytes(), columns)
+	if groups != 1 {
+		t.Errorf("got %d row groups, want 1", groups)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("got rows\n%v\nwant\n%v", got, rows)
+	}
+}
+
+func TestWriterRowGroups(t *testing.T) {
+	columns := []Column{
+		{Name: "n", Type: Int64},
+		{Name: "even", Type: String, Optional: true},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	for i := int64(0); i < RowGroupSize+5; i++ {
+		row := []interface{}{i, nil}
+		if i%2 == 0 {
+			row[1] = "even"
+		}
+		rows = append(rows, row)
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, groups := readFile(t, buf.Bytes(), columns)
+	if groups != 2 {
+		t.Errorf("got %d row groups, want 2", groups)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Error("rows read back don't match the rows written")
+	}
+}
+
+func TestWriterEmpty(t *testing.T) {
+	columns := []Column{{Name: "n", Type: Int64}}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rows, groups := readFile(t, buf.Bytes(), columns); len(rows) != 0 || groups != 0 {
+		t.Errorf("got %d rows in %d row groups, want none", len(rows), groups)
+	}
+}
+
+func TestWriterTypes(t *testing.T) {
+	columns := []Column{
+		{Name: "vehicle_id", Type: String},
+		{Name: "bearing", Type: Float, Optional: true},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]interface{}{
+		{"5001"},
+		{nil, float32(1)},
+		{int64(5001), float32(1)},
+		{"5001", 1.5},
+		{"5001", 1},
+	}
+	for _, row := range invalid {
+		if err := w.Write(row); err == nil {
+			t.Errorf("no error writing %v", row)
+		}
+	}
+
+	// rows which were refused leave nothing behind
+	valid := []interface{}{"5001", float32(90)}
+	if err := w.Write(valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readFile(t, buf.Bytes(), columns); !reflect.DeepEqual(got, [][]interface{}{valid}) {
+		t.Errorf("got rows %v, want only %v", got, valid)
+	}
+}
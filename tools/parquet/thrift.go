@@ -0,0 +1,104 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol type IDs.
+const (
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// compactWriter encodes Thrift structs with the compact protocol, which is how
+// Parquet encodes its page headers and file metadata. Only the types Parquet's
+// metadata needs are supported.
+type compactWriter struct {
+	bytes.Buffer
+	// lastIDs holds the ID of the last field written in each open struct,
+	// since field IDs are written as deltas.
+	lastIDs []int16
+}
+
+func newCompactWriter() *compactWriter {
+	return &compactWriter{lastIDs: []int16{0}}
+}
+
+func (c *compactWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	c.Write(buf[:n])
+}
+
+func (c *compactWriter) zigzag(v int64) {
+	c.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (c *compactWriter) field(id int16, typ byte) {
+	last := &c.lastIDs[len(c.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		c.WriteByte(typ)
+		c.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (c *compactWriter) i32(id int16, v int32) {
+	c.field(id, compactI32)
+	c.zigzag(int64(v))
+}
+
+func (c *compactWriter) i64(id int16, v int64) {
+	c.field(id, compactI64)
+	c.zigzag(v)
+}
+
+func (c *compactWriter) binary(id int16, v []byte) {
+	c.field(id, compactBinary)
+	c.varint(uint64(len(v)))
+	c.Write(v)
+}
+
+func (c *compactWriter) string(id int16, v string) {
+	c.binary(id, []byte(v))
+}
+
+// list writes the header of a list of n elements of typ, which must be
+// followed by the elements themselves.
+func (c *compactWriter) list(id int16, typ byte, n int) {
+	c.field(id, compactList)
+	if n < 15 {
+		c.WriteByte(byte(n)<<4 | typ)
+	} else {
+		c.WriteByte(0xf0 | typ)
+		c.varint(uint64(n))
+	}
+}
+
+func (c *compactWriter) i32Element(v int32) {
+	c.zigzag(int64(v))
+}
+
+func (c *compactWriter) stringElement(v string) {
+	c.varint(uint64(len(v)))
+	c.WriteString(v)
+}
+
+// beginStruct starts a struct field, or a struct element of a list if id is 0.
+func (c *compactWriter) beginStruct(id int16) {
+	if id != 0 {
+		c.field(id, compactStruct)
+	}
+	c.lastIDs = append(c.lastIDs, 0)
+}
+
+func (c *compactWriter) endStruct() {
+	c.WriteByte(0)
+	c.lastIDs = c.lastIDs[:len(c.lastIDs)-1]
+}
@@ -0,0 +1,38 @@
+package tools
+
+import (
+	"github.com/scascketta/capmetricsd/daemon"
+	"log"
+	"time"
+)
+
+// Prune deletes the data in a database older than olderThan, then compacts it
+// unless compact is false, so the space freed is returned to the filesystem.
+func Prune(dbPath string, olderThan time.Duration, compact bool) error {
+	cutoff := time.Now().Add(-olderThan)
+	log.Printf("Pruning data from before %s in DB at: %s\n", cutoff.Format(daemon.ISO8601_FORMAT), dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	stats, err := daemon.Prune(db, cutoff.Unix())
+	if err != nil {
+		db.Close()
+		return err
+	}
+	log.Printf("Pruned %s in %s\n", stats, time.Now().Sub(start))
+
+	if !compact {
+		return db.Close()
+	}
+
+	start = time.Now()
+	before, after, err := daemon.CompactFile(db, dbPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Compacted DB from %d to %d bytes in %s\n", before, after, time.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,26 @@
+package tools
+
+import (
+	"github.com/scascketta/capmetricsd/daemon"
+	"log"
+	"time"
+)
+
+// Reindex backfills the indexes of a database written before they were added.
+func Reindex(dbPath string) error {
+	log.Println("Reindexing DB at:", dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	count, err := daemon.Reindex(db)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Indexed %d locations in %s\n", count, time.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,33 @@
+package tools
+
+import (
+	"github.com/scascketta/capmetricsd/daemon"
+	"log"
+	"time"
+)
+
+// Reprocess decodes the archived raw Vehicle Positions feeds of a database
+// again, storing their locations over those already stored. With replace, the
+// stored locations are replaced by the reprocessed ones instead.
+func Reprocess(dbPath string, replace bool) error {
+	log.Println("Reprocessing raw feeds in DB at:", dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var count int
+	if replace {
+		count, err = daemon.ReprocessFile(db, dbPath)
+	} else {
+		count, err = daemon.Reprocess(db)
+		db.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Stored %d locations in %s\n", count, time.Now().Sub(start))
+	return nil
+}
@@ -0,0 +1,168 @@
+package tools
+
+import (
+	"bytes"
+	"container/heap"
+	"github.com/boltdb/bolt"
+	"github.com/scascketta/capmetricsd/daemon"
+)
+
+// The orders locations can be read in.
+const (
+	SortTrip    = "trip"
+	SortTime    = "time"
+	SortVehicle = "vehicle"
+)
+
+// tripCursor iterates the locations of a trip between two times in time
+// order, optionally only those of a single vehicle.
+type tripCursor struct {
+	trip    []byte
+	vehicle []byte
+	c       *bolt.Cursor
+	max     int64
+	key     []byte
+	value   []byte
+}
+
+func newTripCursor(tripBucket *bolt.Bucket, trip, vehicle []byte, min, max int64) *tripCursor {
+	tc := &tripCursor{trip: trip, vehicle: vehicle, c: tripBucket.Cursor(), max: max}
+	tc.key, tc.value = tc.c.Seek(daemon.TimeKey(min))
+	tc.skip()
+	return tc
+}
+
+// skip moves the cursor past other vehicles' locations, and to the end once
+// it's passed max.
+func (tc *tripCursor) skip() {
+	for tc.key != nil {
+		if daemon.KeyTime(tc.key) > tc.max {
+			tc.key, tc.value = nil, nil
+			return
+		}
+		if tc.vehicle == nil || bytes.Equal(locationKeyVehicle(tc.key), tc.vehicle) {
+			return
+		}
+		tc.key, tc.value = tc.c.Next()
+	}
+}
+
+func (tc *tripCursor) next() {
+	tc.key, tc.value = tc.c.Next()
+	tc.skip()
+}
+
+// locationKeyVehicle returns the vehicle ID suffix of a location key without
+// copying it.
+func locationKeyVehicle(key []byte) []byte {
+	if len(key) < daemon.TIME_KEY_SIZE {
+		return nil
+	}
+	return key[daemon.TIME_KEY_SIZE:]
+}
+
+// byTime orders cursors by the time of their current location, then by trip
+// and vehicle so the order is stable.
+func byTime(a, b *tripCursor) bool {
+	if ta, tb := daemon.KeyTime(a.key), daemon.KeyTime(b.key); ta != tb {
+		return ta < tb
+	}
+	if c := bytes.Compare(a.trip, b.trip); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+// byVehicle orders cursors by vehicle, then by the time of their current
+// location and by trip.
+func byVehicle(a, b *tripCursor) bool {
+	if c := bytes.Compare(a.vehicle, b.vehicle); c != 0 {
+		return c < 0
+	}
+	if ta, tb := daemon.KeyTime(a.key), daemon.KeyTime(b.key); ta != tb {
+		return ta < tb
+	}
+	return bytes.Compare(a.trip, b.trip) < 0
+}
+
+type cursorHeap struct {
+	cursors []*tripCursor
+	less    func(a, b *tripCursor) bool
+}
+
+func (h *cursorHeap) Len() int           { return len(h.cursors) }
+func (h *cursorHeap) Less(i, j int) bool { return h.less(h.cursors[i], h.cursors[j]) }
+func (h *cursorHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *cursorHeap) Push(x interface{}) {
+	h.cursors = append(h.cursors, x.(*tripCursor))
+}
+
+func (h *cursorHeap) Pop() interface{} {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
+
+// tripVehicles returns the vehicles matching q with locations in a trip
+// between q.Min and q.Max.
+func tripVehicles(tripBucket *bolt.Bucket, q *LocationQuery) [][]byte {
+	var vehicles [][]byte
+	seen := map[string]bool{}
+
+	c := tripBucket.Cursor()
+	for k, _ := c.Seek(daemon.TimeKey(q.Min)); k != nil && daemon.KeyTime(k) <= q.Max; k, _ = c.Next() {
+		vehicle := string(locationKeyVehicle(k))
+		if seen[vehicle] {
+			continue
+		}
+		seen[vehicle] = true
+		if len(q.Vehicles) == 0 || matchAny(q.Vehicles, vehicle) {
+			vehicles = append(vehicles, []byte(vehicle))
+		}
+	}
+	return vehicles
+}
+
+// mergeTrips calls visit with the value of every location in trips between
+// q.Min and q.Max, in time order or in vehicle order, by merging a cursor per
+// trip (or per vehicle of each trip) so only one location per cursor is
+// considered at a time.
+func mergeTrips(topBucket *bolt.Bucket, trips [][]byte, q *LocationQuery, order string, visit func(v []byte) error) error {
+	h := &cursorHeap{less: byTime}
+	if order == SortVehicle {
+		h.less = byVehicle
+	}
+
+	for _, trip := range trips {
+		tripBucket := topBucket.Bucket(trip)
+		if tripBucket == nil {
+			continue
+		}
+
+		vehicles := [][]byte{nil}
+		if order == SortVehicle {
+			vehicles = tripVehicles(tripBucket, q)
+		}
+		for _, vehicle := range vehicles {
+			if tc := newTripCursor(tripBucket, trip, vehicle, q.Min, q.Max); tc.key != nil {
+				h.cursors = append(h.cursors, tc)
+			}
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		tc := h.cursors[0]
+		if err := visit(tc.value); err != nil {
+			return err
+		}
+		tc.next()
+		if tc.key == nil {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package tools
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+)
+
+const sortBase = 1449813600
+
+// at returns a location as scan describes it, offset seconds after sortBase.
+func at(trip, vehicle string, offset int64) string {
+	return fmt.Sprintf("%s:%s@%d", trip, vehicle, sortBase+offset)
+}
+
+// sortDB returns a database of three trips: v1 alone on tripA, v2 and v3
+// both reporting on tripB, and v3 moving on to tripC after the last time
+// queried. Several locations share timestamps.
+func sortDB(t *testing.T) (*bolt.DB, func()) {
+	return testDB(t,
+		location("tripA", "v1", "801", sortBase),
+		location("tripA", "v1", "801", sortBase+30),
+		location("tripA", "v1", "801", sortBase+60),
+		location("tripA", "v1", "801", sortBase+90),
+		location("tripB", "v2", "803", sortBase),
+		location("tripB", "v2", "803", sortBase+30),
+		location("tripB", "v3", "803", sortBase+30),
+		location("tripB", "v2", "803", sortBase+60),
+		location("tripC", "v3", "801", sortBase+60),
+		location("tripC", "v3", "801", sortBase+120),
+	)
+}
+
+func TestSortOrders(t *testing.T) {
+	db, cleanup := sortDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		q    LocationQuery
+		want []string
+	}{
+		{
+			name: "time",
+			q:    LocationQuery{Min: sortBase, Max: sortBase + 90, Sort: SortTime},
+			want: []string{
+				at("tripA", "v1", 0), at("tripB", "v2", 0),
+				at("tripA", "v1", 30), at("tripB", "v2", 30), at("tripB", "v3", 30),
+				at("tripA", "v1", 60), at("tripB", "v2", 60), at("tripC", "v3", 60),
+				at("tripA", "v1", 90),
+			},
+		},
+		{
+			name: "trip",
+			q:    LocationQuery{Min: sortBase, Max: sortBase + 90, Sort: SortTrip},
+			want: []string{
+				at("tripA", "v1", 0), at("tripA", "v1", 30), at("tripA", "v1", 60), at("tripA", "v1", 90),
+				at("tripB", "v2", 0), at("tripB", "v2", 30), at("tripB", "v3", 30), at("tripB", "v2", 60),
+				at("tripC", "v3", 60),
+			},
+		},
+		{
+			name: "vehicle",
+			q:    LocationQuery{Min: sortBase, Max: sortBase + 90, Sort: SortVehicle},
+			want: []string{
+				at("tripA", "v1", 0), at("tripA", "v1", 30), at("tripA", "v1", 60), at("tripA", "v1", 90),
+				at("tripB", "v2", 0), at("tripB", "v2", 30), at("tripB", "v2", 60),
+				at("tripB", "v3", 30), at("tripC", "v3", 60),
+			},
+		},
+		{
+			name: "time of one vehicle across trips",
+			q:    LocationQuery{Min: sortBase, Max: sortBase + 120, Vehicles: []string{"v3"}, Sort: SortTime},
+			want: []string{at("tripB", "v3", 30), at("tripC", "v3", 60), at("tripC", "v3", 120)},
+		},
+		{
+			name: "default for vehicles",
+			q:    LocationQuery{Min: sortBase, Max: sortBase + 60, Vehicles: []string{"v3", "v2"}},
+			want: []string{
+				at("tripB", "v2", 0), at("tripB", "v2", 30), at("tripB", "v2", 60),
+				at("tripB", "v3", 30), at("tripC", "v3", 60),
+			},
+		},
+		{
+			name: "single time",
+			q:    LocationQuery{Min: sortBase + 30, Max: sortBase + 30, Sort: SortTime},
+			want: []string{at("tripA", "v1", 30), at("tripB", "v2", 30), at("tripB", "v3", 30)},
+		},
+		{
+			name: "nothing before max",
+			q:    LocationQuery{Min: sortBase - 60, Max: sortBase - 1, Sort: SortVehicle},
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		q := test.q
+		got := scan(t, db, &q)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeTripsSkipsEmptyTrips(t *testing.T) {
+	db, cleanup := sortDB(t)
+	defer cleanup()
+
+	// a trip whose locations have all been pruned
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte(daemon.BUCKET_NAME)).CreateBucket([]byte("tripE"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trips := [][]byte{[]byte("tripA"), []byte("tripE"), []byte("missing"), []byte("tripC")}
+	for _, order := range []string{SortTime, SortVehicle} {
+		q := &LocationQuery{Min: sortBase, Max: sortBase + 60}
+		var got []string
+		err = db.View(func(tx *bolt.Tx) error {
+			return mergeTrips(tx.Bucket([]byte(daemon.BUCKET_NAME)), trips, q, order, func(v []byte) error {
+				var loc gtfsrt.VehicleLocation
+				if err := proto.Unmarshal(v, &loc); err != nil {
+					return err
+				}
+				got = append(got, at(loc.GetTripId(), loc.GetVehicleId(), loc.GetTimestamp()-sortBase))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{at("tripA", "v1", 0), at("tripA", "v1", 30), at("tripA", "v1", 60), at("tripC", "v3", 60)}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", order, got, want)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/scascketta/capmetricsd/daemon"
 	"log"
 	"os"
-	"strconv"
 	"time"
 )
 
@@ -17,10 +16,11 @@ var (
 
 func PrintBoltStats(path string) error {
 	log.Println("Inspecting DB at:", path)
-	db, err := bolt.Open(path, 0666, nil)
+	db, err := openDB(path)
 	if err != nil {
 		return err
 	}
+	defer db.Close()
 
 	return db.View(func(tx *bolt.Tx) error {
 		log.Printf("Inspecting keys in bucket: %s\n", daemon.BUCKET_NAME)
@@ -28,6 +28,9 @@ func PrintBoltStats(path string) error {
 		if b == nil {
 			elog.Fatalf("Nonexistent bucket: %s\n", daemon.BUCKET_NAME)
 		}
+		if err := daemon.CheckKeyFormat(tx); err != nil {
+			return err
+		}
 		keys := 0
 		minTime := MaxTime
 		maxTime := MinTime
@@ -35,11 +38,7 @@ func PrintBoltStats(path string) error {
 			tripBucket := b.Bucket(trip)
 			return tripBucket.ForEach(func(timeBytes, _ []byte) error {
 				keys++
-				timeInt, err := strconv.ParseInt(string(timeBytes), 10, 64)
-				if err != nil {
-					return err
-				}
-				t := time.Unix(int64(timeInt), 0).UTC()
+				t := time.Unix(daemon.KeyTime(timeBytes), 0).UTC()
 
 				if t.Before(minTime) {
 					minTime = t
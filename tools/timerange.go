@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"fmt"
+	"github.com/scascketta/capmetricsd/daemon"
+	"strconv"
+	"time"
+)
+
+// dateLayouts are the formats accepted for the bounds of a TimeRange, tried in
+// order. Times without a zone are read in the range's time zone.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// TimeRange describes a period to query in the forms accepted by get and the
+// HTTP API: From and To bounds, a single Date, or the Last period of time
+// before now. Every form includes its start and excludes its end, so To is the
+// first time not queried. Dates without a time of day start at
+// ServiceDayStart (e.g. "03:00"), so that a day's export lines up with the
+// agency's service day rather than midnight.
+type TimeRange struct {
+	From            string
+	To              string
+	Date            string
+	Last            string
+	TZ              string
+	ServiceDayStart string
+}
+
+// IsSet reports whether any bound of the range was given.
+func (r *TimeRange) IsSet() bool {
+	return r.From != "" || r.To != "" || r.Date != "" || r.Last != ""
+}
+
+// parseClock parses a time of day as HH:MM.
+func parseClock(s string) (hour, min int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("service day start must be HH:MM, got %q", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// parseTime parses a POSIX timestamp or a date in one of dateLayouts. Dates
+// without a time of day are moved to the start of the service day.
+func parseTime(s string, loc *time.Location, hour, min int) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			t = time.Date(t.Year(), t.Month(), t.Day(), hour, min, 0, 0, loc)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q, use a POSIX timestamp or a date like 2016-03-01 or 2016-03-01T15:04", s)
+}
+
+// Resolve returns the first and last POSIX timestamps in the range. To is
+// exclusive, so a range from 2016-03-01 to 2016-03-02 covers a single day.
+func (r *TimeRange) Resolve(now time.Time) (min, max int64, err error) {
+	loc := time.Local
+	if r.TZ != "" {
+		if loc, err = time.LoadLocation(r.TZ); err != nil {
+			return 0, 0, fmt.Errorf("unknown time zone %q: %s", r.TZ, err)
+		}
+	}
+
+	hour, minute, err := parseClock(r.ServiceDayStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	forms := 0
+	for _, given := range []bool{r.From != "" || r.To != "", r.Date != "", r.Last != ""} {
+		if given {
+			forms++
+		}
+	}
+	if forms > 1 {
+		return 0, 0, fmt.Errorf("only one of from/to, date and last can be given")
+	}
+
+	var start, end time.Time
+	switch {
+	case r.Date != "":
+		day, err := time.ParseInLocation("2006-01-02", r.Date, loc)
+		if err != nil {
+			return 0, 0, fmt.Errorf("date must look like 2016-03-01, got %q", r.Date)
+		}
+		start = time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+		// AddDate rather than adding 24 hours, so days around DST changes
+		// still end at the start of the next service day
+		end = start.AddDate(0, 0, 1)
+	case r.Last != "":
+		period, err := daemon.ParseDuration(r.Last)
+		if err != nil || period <= 0 {
+			return 0, 0, fmt.Errorf("invalid period for last: %q", r.Last)
+		}
+		start, end = now.Add(-period), now.Add(time.Second)
+	default:
+		start, end = time.Unix(0, 0), now.Add(time.Second)
+		if r.From != "" {
+			if start, err = parseTime(r.From, loc, hour, minute); err != nil {
+				return 0, 0, err
+			}
+		}
+		if r.To != "" {
+			if end, err = parseTime(r.To, loc, hour, minute); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	min, max = start.Unix(), end.Unix()-1
+	if min < 0 {
+		min = 0
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("range must end after it starts, got %s to %s", start.Format(Iso8601Format), end.Format(Iso8601Format))
+	}
+	return min, max, nil
+}
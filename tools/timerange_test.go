@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeRangeExcludesEnd(t *testing.T) {
+	now := time.Unix(1456876800, 0)
+	tests := []struct {
+		name     string
+		r        TimeRange
+		min, max int64
+	}{
+		{"timestamps", TimeRange{From: "1449813600", To: "1449900000"}, 1449813600, 1449899999},
+		{"dates", TimeRange{From: "2016-03-01", To: "2016-03-02", TZ: "UTC"}, 1456790400, 1456876799},
+		{"date", TimeRange{Date: "2016-03-01", TZ: "UTC"}, 1456790400, 1456876799},
+		{"service day", TimeRange{Date: "2016-03-01", TZ: "UTC", ServiceDayStart: "03:00"}, 1456801200, 1456887599},
+		{"last", TimeRange{Last: "1h"}, 1456873200, 1456876800},
+	}
+	for _, test := range tests {
+		min, max, err := test.r.Resolve(now)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("%s: got %d to %d, want %d to %d", test.name, min, max, test.min, test.max)
+		}
+	}
+
+	// arguments are read the same way as --from and --to
+	min, max, err := ParseTimeRange("1449813600", "1449900000")
+	if err != nil || min != 1449813600 || max != 1449899999 {
+		t.Errorf("got %d to %d, %v, want 1449813600 to 1449899999", min, max, err)
+	}
+	if _, _, err = ParseTimeRange("1449813600", "1449813600"); err == nil {
+		t.Error("no error for an empty range")
+	}
+}
@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"encoding/csv"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/scascketta/capmetricsd/daemon"
+	"github.com/scascketta/capmetricsd/daemon/gtfsrt"
+
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+func readTripUpdates(db daemon.Viewer, min, max int64) (*[]gtfsrt.StopTimePrediction, error) {
+	predictions := []gtfsrt.StopTimePrediction{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		topBucket := tx.Bucket([]byte(daemon.TRIP_UPDATES_BUCKET_NAME))
+		if topBucket == nil {
+			return fmt.Errorf("Nonexistent bucket: %s", daemon.TRIP_UPDATES_BUCKET_NAME)
+		}
+		if err := daemon.CheckKeyFormat(tx); err != nil {
+			return err
+		}
+
+		return topBucket.ForEach(func(tripID, _ []byte) error {
+			tripBucket := topBucket.Bucket(tripID)
+
+			return tripBucket.ForEach(func(stop, _ []byte) error {
+				c := tripBucket.Bucket(stop).Cursor()
+
+				for k, v := c.Seek(daemon.TimeKey(min)); k != nil && daemon.KeyTime(k) <= max; k, v = c.Next() {
+					var prediction gtfsrt.StopTimePrediction
+					if err := proto.Unmarshal(v, &prediction); err != nil {
+						return err
+					}
+
+					predictions = append(predictions, prediction)
+				}
+
+				return nil
+			})
+		})
+	})
+
+	return &predictions, err
+}
+
+// formatOptional formats set values, leaving unset ones empty rather than zero
+// since a delay of 0 means on time.
+func formatOptional(isSet bool, v int64) string {
+	if !isSet {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func formatOptionalTime(isSet bool, v int64) string {
+	if !isSet {
+		return ""
+	}
+	return time.Unix(v, 0).Local().Format(Iso8601Format)
+}
+
+func writeTripUpdates(dest string, predictions *[]gtfsrt.StopTimePrediction) error {
+	log.Printf("Writing %d stop time predictions to %s.\n", len(*predictions), dest)
+
+	headers := []string{
+		"trip_id", "route_id", "vehicle_id", "timestamp", "stop_sequence", "stop_id",
+		"arrival_delay", "arrival_time", "arrival_uncertainty",
+		"departure_delay", "departure_time", "departure_uncertainty",
+		"schedule_relationship",
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err = w.Write(headers); err != nil {
+		log.Println("Error writing CSV header record")
+		return err
+	}
+
+	for _, p := range *predictions {
+		record := []string{
+			p.GetTripId(),
+			p.GetRouteId(),
+			p.GetVehicleId(),
+			time.Unix(p.GetTimestamp(), 0).Local().Format(Iso8601Format),
+			formatOptional(p.StopSequence != nil, int64(p.GetStopSequence())),
+			p.GetStopId(),
+			formatOptional(p.ArrivalDelay != nil, int64(p.GetArrivalDelay())),
+			formatOptionalTime(p.ArrivalTime != nil, p.GetArrivalTime()),
+			formatOptional(p.ArrivalUncertainty != nil, int64(p.GetArrivalUncertainty())),
+			formatOptional(p.DepartureDelay != nil, int64(p.GetDepartureDelay())),
+			formatOptionalTime(p.DepartureTime != nil, p.GetDepartureTime()),
+			formatOptional(p.DepartureUncertainty != nil, int64(p.GetDepartureUncertainty())),
+			p.GetScheduleRelationship(),
+		}
+		if err = w.Write(record); err != nil {
+			log.Println("Error writing CSV records")
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func GetTripUpdates(dbPath, dest string, min string, max string) error {
+	log.Printf("Get trip updates between %s and %s\n", min, max)
+
+	minTime, maxTime, err := ParseTimeRange(min, max)
+	if err != nil {
+		return err
+	}
+
+	log.Println("dbPath: ", dbPath)
+	db, err := openDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	predictions, err := readTripUpdates(db, minTime, maxTime)
+	if err != nil {
+		return err
+	}
+
+	return writeTripUpdates(dest, predictions)
+}